@@ -0,0 +1,86 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadBenchResults reads Go benchmark results from path, like
+//
+//	BenchmarkEtcdPut-16 100000 18855813 ns/op ... 51722 ops/s
+//
+// and sets Ops for each AppProfile whose Benchmark matches one of them,
+// and OpsPerSec if the result has an ops/s metric. Other lines are
+// ignored. If a benchmark appears more than once, the last result wins.
+func loadBenchResults(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		name, ops, opsPerSec, haveOpsPerSec, err := parseBenchLine(s.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if name == "" {
+			continue
+		}
+		for i := range AppProfiles {
+			if AppProfiles[i].Benchmark == name {
+				AppProfiles[i].Ops = ops
+				if haveOpsPerSec {
+					AppProfiles[i].OpsPerSec = opsPerSec
+				}
+			}
+		}
+	}
+	return s.Err()
+}
+
+// parseBenchLine parses a benchmark result line. It returns the name of
+// the benchmark without its -GOMAXPROCS suffix, the number of iterations
+// and the ops/s metric, if there is one. If line isn't a benchmark result,
+// name is "".
+func parseBenchLine(line string) (name string, ops uint64, opsPerSec float64, haveOpsPerSec bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "Benchmark") {
+		return "", 0, 0, false, nil
+	}
+	ops, err = strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		// Not a result, like a benchmark's own output.
+		return "", 0, 0, false, nil
+	}
+	name = fields[0]
+	if i := strings.LastIndexByte(name, '-'); i >= 0 {
+		if _, err := strconv.Atoi(name[i+1:]); err == nil {
+			name = name[:i]
+		}
+	}
+	if len(fields)%2 != 0 {
+		// Not a well-formed result either, like a line that got
+		// mixed up with other output.
+		return "", 0, 0, false, nil
+	}
+	for i := 2; i < len(fields); i += 2 {
+		if fields[i+1] != "ops/s" {
+			continue
+		}
+		opsPerSec, err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return "", 0, 0, false, fmt.Errorf("parsing ops/s of %s: %v", fields[0], err)
+		}
+		haveOpsPerSec = true
+	}
+	return name, ops, opsPerSec, haveOpsPerSec, nil
+}
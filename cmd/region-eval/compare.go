@@ -0,0 +1,73 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// writeComparison writes ∆CPU% with an application per row and a scenario
+// per column. The best scenario for each application, the one that saves
+// the most CPU, is marked with a * and named in the last column. The last
+// row is the geometric mean of each scenario's CPU ratio across all
+// applications.
+func writeComparison(t *table, apps []AppProfile, scenarios []Scenario, varyProg *VaryProgram) {
+	cols := []string{"Application"}
+	for _, scenario := range scenarios {
+		cols = append(cols, scenarioLabel(scenario, varyProg))
+	}
+	t.header(append(cols, "Best")...)
+
+	if len(apps) == 0 || len(scenarios) == 0 {
+		return
+	}
+	logSums := make([]float64, len(scenarios))
+	row := func(name string, fracs []float64) {
+		best := 0
+		for i, frac := range fracs {
+			if frac < fracs[best] {
+				best = i
+			}
+		}
+		cells := []string{name}
+		for i, frac := range fracs {
+			cell := fmt.Sprintf("%+.2f%%", frac*100)
+			if i == best {
+				cell += "*"
+			}
+			cells = append(cells, cell)
+		}
+		t.row(append(cells, cols[best+1])...)
+	}
+	for _, app := range apps {
+		fracs := make([]float64, len(scenarios))
+		for i, scenario := range scenarios {
+			fracs[i] = deltaCPUFrac(app, scenario)
+			logSums[i] += math.Log1p(fracs[i])
+		}
+		row(app.Name, fracs)
+	}
+	geomeans := make([]float64, len(scenarios))
+	for i, sum := range logSums {
+		geomeans[i] = math.Expm1(sum / float64(len(apps)))
+	}
+	row("Geomean", geomeans)
+}
+
+// scenarioLabel names scenario, along with the values of any parameters
+// varyProg varies, which would otherwise be the same for all of them.
+func scenarioLabel(scenario Scenario, varyProg *VaryProgram) string {
+	if varyProg == nil {
+		return scenario.Name
+	}
+	var b strings.Builder
+	b.WriteString(scenario.Name)
+	for _, p := range varyProg.Params() {
+		fmt.Fprintf(&b, " %s=%.3f", p, *param2Extractor[p](&scenario))
+	}
+	return b.String()
+}
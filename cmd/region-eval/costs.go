@@ -0,0 +1,134 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/mknyszek/region-eval/cpusim"
+)
+
+// CostModel holds the CPU costs, in nanoseconds, of region operations for
+// one cpusim block geometry. They're fit to cpusim's benchmarks, which
+// depend on the geometry, so each geometry needs its own coefficients.
+//
+// The region write barrier is split in two. The check runs on every
+// pointer write, since unlike Go's write barrier it can't be turned off
+// outside of GC marking, and it filters out writes that don't involve
+// regions. The test is the rest of the work, done for writes that get
+// past the check.
+type CostModel struct {
+	Geometry           string  // As reported by cpusim.Geometry.
+	BumpAllocPerObject float64 // Region allocation, per object.
+	BumpAllocPerByte   float64 // Region allocation, per byte.
+	WBCheckPerWrite    float64 // Always-on region write barrier check, per pointer write.
+	WBTestPerWrite     float64 // Region write barrier test, per pointer write.
+	FadePerObject      float64 // Fading an escaped object, per object.
+	FadePerPointer     float64 // Fading an escaped object, per pointer in it.
+
+	// WBTestPerKind is the region write barrier test, per pointer write
+	// of each cpusim.WriteKind, from BenchmarkWriteBarrierKinds less
+	// WBCheckPerWrite. If it's all zero, writes of pointers into region
+	// memory cost WBTestPerWrite and all others are free.
+	WBTestPerKind [cpusim.NumWriteKinds]float64
+}
+
+// CostModels are the cost models for the geometries cpusim has been
+// benchmarked with, from results/cpusim_gomote.bench. Others may be added
+// with -costs.
+var CostModels = []CostModel{
+	{
+		Geometry:           "8KiB/128B",
+		BumpAllocPerObject: 8,
+		BumpAllocPerByte:   0.15,
+		// BenchmarkWriteBarrierKinds/kind=Neither only does the check,
+		// but there's no gomote run of it yet. It was run interleaved
+		// with BenchmarkWriteBarrier/shuffle=false/percentPreEscaped=0
+		// on another machine (results/cpusim_wbkinds.bench, benchstat
+		// 6.83ns ±27% and 8.70ns ±27%). The median ratio of the
+		// two over the 30 paired rounds is 0.79 (IQR 0.70-0.83), which
+		// is scaled by the latter's 3.82ns ±2% in the gomote results.
+		// It includes the store and the benchmark loop, so it's an
+		// overestimate.
+		//
+		// TODO: Run BenchmarkWriteBarrierKinds on the gomote and use
+		// kind=Neither directly.
+		WBCheckPerWrite: 3.0,
+		WBTestPerWrite:  5.2,
+		FadePerObject:   40,
+		FadePerPointer:  3.37,
+	},
+}
+
+// wbTest returns the cost of the region write barrier test for a pointer
+// write of kind k.
+func (m *CostModel) wbTest(k cpusim.WriteKind) float64 {
+	if m.WBTestPerKind != ([cpusim.NumWriteKinds]float64{}) {
+		return m.WBTestPerKind[k]
+	}
+	if k&cpusim.WriteSrcRegion != 0 {
+		return m.WBTestPerWrite
+	}
+	return 0
+}
+
+// costs is the cost model for the geometry being evaluated.
+var costs = CostModels[0]
+
+// loadCostModels reads a JSON array of CostModels from path and adds them
+// to CostModels, replacing any existing models for the same geometries.
+func loadCostModels(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var models []CostModel
+	if err := json.Unmarshal(data, &models); err != nil {
+		return fmt.Errorf("parsing cost models %s: %v", path, err)
+	}
+	for _, m := range models {
+		if i := findCostModel(m.Geometry); i >= 0 {
+			CostModels[i] = m
+		} else {
+			CostModels = append(CostModels, m)
+		}
+	}
+	return nil
+}
+
+// selectCostModel sets costs to the cost model for geometry.
+//
+// If there's no model for geometry and fallback is set, it warns and
+// uses the first model instead. This is for the default geometry, which
+// comes from cpusim's build tags and so doesn't necessarily have a
+// measured cost model. A geometry that was asked for explicitly should
+// not fall back, since the results would silently be for a different one.
+func selectCostModel(geometry string, fallback bool) error {
+	i := findCostModel(geometry)
+	if i < 0 {
+		var known []string
+		for _, m := range CostModels {
+			known = append(known, m.Geometry)
+		}
+		if !fallback {
+			return fmt.Errorf("no cost model for geometry %s (have %v); benchmark cpusim built with that geometry and pass the coefficients with -costs", geometry, known)
+		}
+		fmt.Fprintf(os.Stderr, "warning: no cost model for geometry %s (have %v), using %s's; benchmark cpusim built with that geometry and pass the coefficients with -costs\n", geometry, known, CostModels[0].Geometry)
+		i = 0
+	}
+	costs = CostModels[i]
+	return nil
+}
+
+func findCostModel(geometry string) int {
+	for i, m := range CostModels {
+		if m.Geometry == geometry {
+			return i
+		}
+	}
+	return -1
+}
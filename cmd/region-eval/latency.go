@@ -0,0 +1,95 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// deltaLatencyFrac estimates the relative change in prof's p50 and p99
+// request latency under scenario. ok is false if prof has no latency
+// profile. A change is +Inf if regions push utilization to 1 or more.
+//
+// Requests are modeled as an M/G/k queue with k = Servers, using the
+// Allen–Cunneen approximation: queueing delay is that of an M/M/k queue
+// with the same mean service time, scaled by (1+C_s²)/2, where C_s is the
+// coefficient of variation of service time. Service time is assumed to be
+// log-normal, which fits the long tails of real request latencies.
+//
+// C_s is estimated from the spread between the baseline p50 and p99,
+// which overstates it, since some of that spread is queueing delay. Each
+// baseline percentile is then split into queueing delay, from the model,
+// and service time, which is the rest. Service time is scaled by the
+// change in CPU on the request path: everything except GC work that isn't
+// done by assists. Utilization is scaled by the change in total CPU.
+func deltaLatencyFrac(prof AppProfile, scenario Scenario) (p50, p99 float64, ok bool) {
+	l := prof.Latency
+	if l == nil {
+		return 0, 0, false
+	}
+	rho := l.Utilization
+	if rho == 0 {
+		rho = *utilization
+	}
+	k := l.Servers
+
+	// Fit the baseline. sigma is the log-normal shape parameter, mean
+	// the mean service time in units of the median, and s50 and s99
+	// the median and p99 service times.
+	sigma := math.Log(float64(l.P99)/float64(l.P50)) / z99
+	mean := math.Exp(sigma * sigma / 2)
+	cs2 := math.Exp(sigma*sigma) - 1
+	g50, g99 := queueFactor(k, rho, cs2, 0.5), queueFactor(k, rho, cs2, 0.99)
+	s50 := float64(l.P50) / (1 + mean*g50)
+	s99 := max(float64(l.P99)-s50*mean*g99, s50)
+
+	// Apply the change.
+	reqCPU := prof.TotalCPU - prof.GCCPU + prof.AssistCPU
+	dGC := deltaGCCPU(prof, scenario)
+	dReq := deltaCPU(prof, scenario) - dGC
+	if prof.GCCPU != 0 {
+		dReq += time.Duration(float64(dGC) * float64(prof.AssistCPU) / float64(prof.GCCPU))
+	}
+	scale := 1 + float64(dReq)/float64(reqCPU)
+	rho *= 1 + deltaCPUFrac(prof, scenario)
+	if rho >= 1 {
+		return math.Inf(1), math.Inf(1), true
+	}
+	g50, g99 = queueFactor(k, rho, cs2, 0.5), queueFactor(k, rho, cs2, 0.99)
+	p50 = s50*scale*(1+mean*g50)/float64(l.P50) - 1
+	p99 = (s99+s50*mean*g99)*scale/float64(l.P99) - 1
+	return p50, p99, true
+}
+
+// z99 is the 99th percentile of the standard normal distribution.
+const z99 = 2.3263478740408408
+
+// queueFactor returns the p'th percentile of the queueing delay in an
+// M/G/k queue with utilization rho and squared coefficient of variation
+// of service time cs2, in units of the mean service time.
+func queueFactor(k int, rho, cs2, p float64) float64 {
+	// In an M/M/k queue, the delay is 0 with probability 1-C, and
+	// otherwise exponential with rate k(1-rho). Allen–Cunneen scales
+	// the delay for other service time distributions.
+	c := erlangC(k, rho)
+	if c <= 1-p {
+		return 0
+	}
+	return (1 + cs2) / 2 * math.Log(c/(1-p)) / (float64(k) * (1 - rho))
+}
+
+// erlangC returns the probability that a request has to wait in an M/M/k
+// queue with utilization rho.
+func erlangC(k int, rho float64) float64 {
+	a := float64(k) * rho
+	term, sum := 1.0, 0.0 // a^i/i!
+	for i := range k {
+		sum += term
+		term *= a / float64(i+1)
+	}
+	last := term / (1 - rho)
+	return last / (sum + last)
+}
@@ -16,6 +16,8 @@ import (
 	"strconv"
 	"strings"
 	"text/tabwriter"
+
+	"github.com/mknyszek/region-eval/cpusim"
 )
 
 const (
@@ -23,16 +25,33 @@ const (
 	TSV  = "tsv"
 )
 
+const (
+	Table   = "table"
+	Savings = "savings"
+	Compare = "compare"
+)
+
 var (
 	allFormats = []string{Text, TSV}
+	allModes   = []string{Table, Savings, Compare}
 	allParams  = slices.Collect(maps.Keys(param2Extractor))
 )
 
 var (
 	outputFormat  = flag.String("format", Text, fmt.Sprintf("output format %v", allFormats))
+	mode          = flag.String("mode", Table, fmt.Sprintf("what to report %v; savings needs -fleet", allModes))
 	applicationRe = flag.String("app", ".*", "application regexp")
 	scenarioRe    = flag.String("scenario", ".*", "scenario regexp")
-	vary          = flag.String("vary", "", fmt.Sprintf("parameters to vary with the format <name1>=[<lo>:<hi>],<name2>=[<lo>:<hi>].../<steps>; supported parameters: %v", allParams))
+	vary          = flag.String("vary", "", fmt.Sprintf("parameters to vary with the format <name1>=[<lo>:<hi>],<name2>=[<lo>:<hi>].../<steps>, varied together; separate several of those with ; to vary them over a grid; supported parameters: %v", allParams))
+	traces        = flag.String("trace", "", "comma-separated list of allocation traces to replay through cpusim and add as measured scenarios")
+	traceScanned  = flag.Float64("trace-scanned", 0.01, "ScannedRegionAllocBytesFrac to assume for -trace scenarios, since replays don't simulate scanning")
+	traceScanCost = flag.Float64("trace-scan-cost", 1.05, "RegionScanCostRatio to assume for -trace scenarios, since replays don't simulate scanning")
+	geometry      = flag.String("geometry", cpusim.Geometry(), fmt.Sprintf("cpusim block geometry to use cost coefficients for; if unset and there are none for the default, falls back to %s's with a warning", CostModels[0].Geometry))
+	costModels    = flag.String("costs", "", "JSON file with additional cost models, as a list of CostModel")
+	benchResults  = flag.String("bench", "", "comma-separated list of Go benchmark results files to take application operation counts and throughput from")
+	utilization   = flag.Float64("utilization", 0.5, "utilization of applications whose latency profile doesn't specify one")
+	plotFile      = flag.String("plot", "", "SVG file to plot ∆CPU% over the -vary sweep to")
+	fleetFile     = flag.String("fleet", "", "JSON file describing the fleet, as a Fleet, for -mode=savings")
 )
 
 func init() {
@@ -58,45 +77,44 @@ func run() error {
 		return fmt.Errorf("parsing scenario regexp: %v", err)
 	}
 
-	// Set up output.
-	var (
-		writeHeader func()
-		writeRecord func(AppProfile, Scenario, float64)
-	)
-	switch format := *outputFormat; format {
-	case Text, TSV:
-		var w io.Writer = os.Stdout
-		if format == Text {
-			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-			defer tw.Flush()
-			w = tw
-		}
-		writeHeader = func() {
-			fmt.Fprintf(w, "Application\tGC CPU%%\tAlloc CPU%%\tScenario\tB_R\tO_R\tB_F\tO_F\tB_S\tC_R\tP_F\t∆CPU%%\tWB CPU%%\t∆Alloc CPU%%\n")
-			if format == Text {
-				fmt.Fprintf(w, "-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\n")
+	if *utilization <= 0 || *utilization >= 1 {
+		return fmt.Errorf("utilization must be in (0, 1), got %v", *utilization)
+	}
+
+	// Pick cost coefficients.
+	if *costModels != "" {
+		if err := loadCostModels(*costModels); err != nil {
+			return err
+		}
+	}
+	geometrySet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "geometry" {
+			geometrySet = true
+		}
+	})
+	if err := selectCostModel(*geometry, !geometrySet); err != nil {
+		return err
+	}
+
+	// Update operation counts.
+	if *benchResults != "" {
+		for _, path := range strings.Split(*benchResults, ",") {
+			if err := loadBenchResults(path); err != nil {
+				return err
 			}
 		}
-		writeRecord = func(app AppProfile, scenario Scenario, cpuFrac float64) {
-			fmt.Fprintf(w, "%s\t%.2f%%\t%.2f%%\t%s\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%+.2f%%\t%+.2f%%\t %+.2f%%\n",
-				app.Name,
-				float64(app.GCCPU)/float64(app.TotalCPU)*100,
-				float64(baseAllocCPU(app.Allocs, app.AllocBytes))/float64(app.TotalCPU)*100,
-				scenario.Name,
-				scenario.RegionAllocBytesFrac,
-				scenario.RegionAllocsFrac,
-				scenario.FadeAllocBytesFrac,
-				scenario.FadeAllocsFrac,
-				scenario.ScannedRegionAllocBytesFrac,
-				scenario.RegionScanCostRatio,
-				scenario.FadeAllocsPointerDensity,
-				cpuFrac*100,
-				float64(wbTestCPU(scenario.RegionAllocsFrac, app.PointerWrites))/float64(app.TotalCPU)*100,
-				float64(deltaAllocCPU(app, scenario))/float64(app.TotalCPU)*100,
-			)
+	}
+
+	// Add measured scenarios.
+	if *traces != "" {
+		for _, path := range strings.Split(*traces, ",") {
+			scenario, err := measureScenario(path, *traceScanned, *traceScanCost)
+			if err != nil {
+				return err
+			}
+			Scenarios = append(Scenarios, scenario)
 		}
-	default:
-		return fmt.Errorf("unknown output format %q", *outputFormat)
 	}
 
 	// Set up programs to vary some variables.
@@ -108,39 +126,193 @@ func run() error {
 		}
 	}
 
-	// Write output.
-	writeHeader()
+	if *plotFile != "" {
+		if err := checkPlot(*plotFile, varyProg); err != nil {
+			return err
+		}
+	}
+
+	// Select applications and scenarios.
+	var apps []AppProfile
 	for _, app := range AppProfiles {
-		if !appRegexp.MatchString(app.Name) {
+		if appRegexp.MatchString(app.Name) {
+			apps = append(apps, app)
+		}
+	}
+	var base, scenarios []Scenario
+	for _, scenario := range Scenarios {
+		if !scnRegexp.MatchString(scenario.Name) {
 			continue
 		}
-		for _, scenario := range Scenarios {
-			if !scnRegexp.MatchString(scenario.Name) {
-				continue
-			}
-			if varyProg != nil {
-				for scenario := range varyProg.Vary(scenario) {
-					writeRecord(app, scenario, deltaCPUFrac(app, scenario))
-				}
-			} else {
-				writeRecord(app, scenario, deltaCPUFrac(app, scenario))
-			}
+		base = append(base, scenario)
+		if varyProg != nil {
+			scenarios = slices.AppendSeq(scenarios, varyProg.Vary(scenario))
+		} else {
+			scenarios = append(scenarios, scenario)
 		}
 	}
+
+	// Write output.
+	t, err := newTable(*outputFormat)
+	if err != nil {
+		return err
+	}
+	defer t.flush()
+	switch *mode {
+	case Table:
+		writeTable(t, apps, scenarios)
+	case Savings:
+		if *fleetFile == "" {
+			return fmt.Errorf("-mode=%s needs -fleet", Savings)
+		}
+		fleet, err := loadFleet(*fleetFile)
+		if err != nil {
+			return err
+		}
+		writeSavings(t, fleet, apps, scenarios, varyProg)
+	case Compare:
+		writeComparison(t, apps, scenarios, varyProg)
+	default:
+		return fmt.Errorf("unknown mode %q", *mode)
+	}
+	if *plotFile != "" {
+		return writePlot(*plotFile, apps, base, varyProg)
+	}
 	return nil
 }
 
+// table writes tab-separated rows, aligned into columns in Text format.
+type table struct {
+	w     io.Writer
+	text  bool
+	flush func() error
+}
+
+func newTable(format string) (*table, error) {
+	switch format {
+	case Text:
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		return &table{w: tw, text: true, flush: tw.Flush}, nil
+	case TSV:
+		return &table{w: os.Stdout, flush: func() error { return nil }}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// header writes the column names, underlined in Text format.
+func (t *table) header(cols ...string) {
+	t.row(cols...)
+	if t.text {
+		t.row(slices.Repeat([]string{"-"}, len(cols))...)
+	}
+}
+
+func (t *table) row(cells ...string) {
+	fmt.Fprintln(t.w, strings.Join(cells, "\t"))
+}
+
+// writeTable writes the effect of each scenario on each application and
+// each of its components.
+func writeTable(t *table, apps []AppProfile, scenarios []Scenario) {
+	t.header("Application", "GC CPU%", "Alloc CPU%", "Scenario", "B_R", "O_R", "B_F", "O_F", "B_S", "C_R", "P_F", "∆CPU%", "WB Check CPU%", "WB CPU%", "∆Alloc CPU%", "∆p50%", "∆p99%", "∆CPU ns/op", "ops/s")
+	writeRecord := func(app AppProfile, scenario Scenario, cpuFrac float64) {
+		p50, p99 := "-", "-"
+		if d50, d99, ok := deltaLatencyFrac(app, scenario); ok {
+			p50, p99 = fmt.Sprintf("%+.2f%%", d50*100), fmt.Sprintf("%+.2f%%", d99*100)
+		}
+		nsPerOp, opsPerSec := "-", "-"
+		if app.Ops != 0 {
+			// Throughput is at a fixed CPU budget, so it scales
+			// inversely with CPU per operation.
+			nsPerOp = fmt.Sprintf("%+.0f", float64(deltaCPU(app, scenario))/float64(app.Ops))
+			opsPerSec = fmt.Sprintf("%.0f", app.OpsPerSec/(1+cpuFrac))
+		}
+		fmt.Fprintf(t.w, "%s\t%.2f%%\t%.2f%%\t%s\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%+.2f%%\t%+.2f%%\t%+.2f%%\t %+.2f%%\t%s\t%s\t%s\t%s\n",
+			app.Name,
+			float64(app.GCCPU)/float64(app.TotalCPU)*100,
+			float64(baseAllocCPU(app.Allocs, app.AllocBytes))/float64(app.TotalCPU)*100,
+			scenario.Name,
+			scenario.RegionAllocBytesFrac,
+			scenario.RegionAllocsFrac,
+			scenario.FadeAllocBytesFrac,
+			scenario.FadeAllocsFrac,
+			scenario.ScannedRegionAllocBytesFrac,
+			scenario.RegionScanCostRatio,
+			scenario.FadeAllocsPointerDensity,
+			cpuFrac*100,
+			float64(wbCheckCPU(app))/float64(app.TotalCPU)*100,
+			float64(wbCPU(app, scenario))/float64(app.TotalCPU)*100,
+			float64(deltaAllocCPU(app, scenario))/float64(app.TotalCPU)*100,
+			p50, p99,
+			nsPerOp, opsPerSec,
+		)
+	}
+	for _, app := range apps {
+		for _, scenario := range scenarios {
+			// Write the whole application, then each of its
+			// components.
+			writeRecord(app, scenario, deltaCPUFrac(app, scenario))
+			for _, c := range app.Components {
+				c.Name = app.Name + "/" + c.Name
+				writeRecord(c, scenario, deltaCPUFrac(c, scenario))
+			}
+		}
+	}
+}
+
 type VaryProgram struct {
 	vars  []varyVar
 	steps int
+
+	// inner, if not nil, is varied in full at each step, to sweep a
+	// grid instead of a line.
+	inner *VaryProgram
 }
 
 type varyVar struct {
+	name    string
 	extract func(*Scenario) *float64
 	lo, hi  float64
 }
 
+// Params returns the names of the parameters vp varies.
+func (vp *VaryProgram) Params() []string {
+	var names []string
+	for _, v := range vp.vars {
+		names = append(names, v.name)
+	}
+	if vp.inner != nil {
+		names = append(names, vp.inner.Params()...)
+	}
+	return names
+}
+
+// Axes returns the dimensions of the sweep, outermost first.
+func (vp *VaryProgram) Axes() []*VaryProgram {
+	axes := []*VaryProgram{vp}
+	if vp.inner != nil {
+		axes = append(axes, vp.inner.Axes()...)
+	}
+	return axes
+}
+
 func (vp *VaryProgram) Vary(scenario Scenario) iter.Seq[Scenario] {
+	if vp.inner == nil {
+		return vp.sweep(scenario)
+	}
+	return func(yield func(Scenario) bool) {
+		for scenario := range vp.sweep(scenario) {
+			for scenario := range vp.inner.Vary(scenario) {
+				if !yield(scenario) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// sweep varies vp's own parameters, and not those of inner.
+func (vp *VaryProgram) sweep(scenario Scenario) iter.Seq[Scenario] {
 	return func(yield func(Scenario) bool) {
 		if vp.steps == 0 {
 			return
@@ -191,6 +363,18 @@ var param2Extractor = map[string]func(*Scenario) *float64{
 }
 
 func parseVaryProgram(vp string) (*VaryProgram, error) {
+	if outer, inner, ok := strings.Cut(vp, ";"); ok {
+		outerProg, err := parseVaryProgram(outer)
+		if err != nil {
+			return nil, err
+		}
+		innerProg, err := parseVaryProgram(inner)
+		if err != nil {
+			return nil, err
+		}
+		outerProg.inner = innerProg
+		return outerProg, nil
+	}
 	var vars []varyVar
 	for {
 		i := strings.IndexByte(vp, '=')
@@ -224,7 +408,7 @@ func parseVaryProgram(vp string) (*VaryProgram, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid vary program: cannot parse hi: %s", vp[:i])
 		}
-		vars = append(vars, varyVar{extract, lo, hi})
+		vars = append(vars, varyVar{param, extract, lo, hi})
 		vp = vp[i+1:]
 		if vp[0] == '/' {
 			vp = vp[1:]
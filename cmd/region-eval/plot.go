@@ -0,0 +1,296 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Plot layout, in pixels.
+const (
+	plotW, plotH   = 480, 300 // Plot area of each panel.
+	marginL        = 70
+	marginR        = 180 // Room for the legend.
+	marginT        = 40
+	marginB        = 50
+	panelW, panelH = marginL + plotW + marginR, marginT + plotH + marginB
+)
+
+// palette colors the lines of a line chart.
+var palette = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+// checkPlot returns an error if the sweep of varyProg can't be plotted to
+// path.
+func checkPlot(path string, varyProg *VaryProgram) error {
+	if varyProg == nil {
+		return fmt.Errorf("-plot needs -vary")
+	}
+	if filepath.Ext(path) != ".svg" {
+		return fmt.Errorf("can only plot to .svg files, not %s", path)
+	}
+	if n := len(varyProg.Axes()); n > 2 {
+		return fmt.Errorf("can only plot sweeps over 1 or 2 axes, not %d", n)
+	}
+	for _, axis := range varyProg.Axes() {
+		if axis.steps < 1 {
+			return fmt.Errorf("can't plot a sweep of %d steps", axis.steps)
+		}
+	}
+	return nil
+}
+
+// writePlot renders ∆CPU% over the sweep of varyProg as an SVG file at
+// path. A sweep along one axis gets a line chart per application, with a
+// line per scenario. A sweep over a grid gets a heatmap per application
+// and scenario. Either way, break-even at 0% is drawn in.
+func writePlot(path string, apps []AppProfile, scenarios []Scenario, varyProg *VaryProgram) error {
+	var s svg
+	if axes := varyProg.Axes(); len(axes) == 1 {
+		plotLines(&s, apps, scenarios, axes[0])
+	} else {
+		plotHeatmaps(&s, apps, scenarios, axes[0], axes[1])
+	}
+	return os.WriteFile(path, []byte(s.String()), 0o666)
+}
+
+// svg builds an SVG document.
+type svg struct {
+	strings.Builder
+}
+
+func (s *svg) printf(format string, args ...any) {
+	fmt.Fprintf(&s.Builder, format, args...)
+}
+
+func (s *svg) begin(w, h int) {
+	s.printf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`+"\n", w, h, w, h)
+	s.printf(`<rect width="%d" height="%d" fill="white"/>`+"\n", w, h)
+}
+
+func (s *svg) end() {
+	s.printf("</svg>\n")
+}
+
+// text writes str at (x, y). anchor is start, middle or end.
+func (s *svg) text(x, y float64, anchor, str string) {
+	s.printf(`<text x="%.1f" y="%.1f" text-anchor="%s">%s</text>`+"\n", x, y, anchor, html.EscapeString(str))
+}
+
+func (s *svg) line(x1, y1, x2, y2 float64, style string) {
+	s.printf(`<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" %s/>`+"\n", x1, y1, x2, y2, style)
+}
+
+// axisLabel names the parameters an axis varies together.
+func axisLabel(axis *VaryProgram) string {
+	var names []string
+	for _, v := range axis.vars {
+		names = append(names, v.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// axisValue returns scenario's position along axis, which is the value of
+// the first parameter it varies.
+func axisValue(axis *VaryProgram, scenario Scenario) float64 {
+	return *axis.vars[0].extract(&scenario)
+}
+
+// ticks returns n evenly spaced values from lo to hi.
+func ticks(lo, hi float64, n int) []float64 {
+	var ts []float64
+	for i := range n {
+		ts = append(ts, lo+(hi-lo)*float64(i)/float64(n-1))
+	}
+	return ts
+}
+
+// plotLines draws a line chart of ∆CPU% against axis for each application,
+// one above the other.
+func plotLines(s *svg, apps []AppProfile, scenarios []Scenario, axis *VaryProgram) {
+	s.begin(panelW, panelH*len(apps))
+	for i, app := range apps {
+		// Compute the lines and their bounds.
+		type point struct{ x, y float64 }
+		lines := make([][]point, len(scenarios))
+		xlo, xhi := math.Inf(1), math.Inf(-1)
+		ylo, yhi := 0.0, 0.0
+		for j, scenario := range scenarios {
+			for scenario := range axis.sweep(scenario) {
+				p := point{axisValue(axis, scenario), deltaCPUFrac(app, scenario) * 100}
+				lines[j] = append(lines[j], p)
+				xlo, xhi = min(xlo, p.x), max(xhi, p.x)
+				ylo, yhi = min(ylo, p.y), max(yhi, p.y)
+			}
+		}
+		if xlo == xhi {
+			xlo, xhi = xlo-0.5, xhi+0.5
+		}
+		if ylo == yhi {
+			ylo, yhi = -1, 1
+		}
+		pad := (yhi - ylo) * 0.05
+		ylo, yhi = ylo-pad, yhi+pad
+
+		top := float64(panelH * i)
+		px := func(x float64) float64 { return marginL + (x-xlo)/(xhi-xlo)*plotW }
+		py := func(y float64) float64 { return top + marginT + (yhi-y)/(yhi-ylo)*plotH }
+
+		// Frame, ticks and labels.
+		s.text(marginL+plotW/2, top+marginT-15, "middle", app.Name)
+		s.printf(`<rect x="%d" y="%.1f" width="%d" height="%d" fill="none" stroke="black"/>`+"\n", marginL, top+marginT, plotW, plotH)
+		for _, x := range ticks(xlo, xhi, 6) {
+			s.line(px(x), top+marginT+plotH, px(x), top+marginT+plotH+5, `stroke="black"`)
+			s.text(px(x), top+marginT+plotH+18, "middle", fmt.Sprintf("%.3g", x))
+		}
+		for _, y := range ticks(ylo, yhi, 6) {
+			s.line(marginL-5, py(y), marginL, py(y), `stroke="black"`)
+			s.text(marginL-8, py(y)+4, "end", fmt.Sprintf("%.2f%%", y))
+		}
+		s.text(marginL+plotW/2, top+marginT+plotH+40, "middle", axisLabel(axis))
+		s.printf(`<text transform="translate(15,%.1f) rotate(-90)" text-anchor="middle">∆CPU%%</text>`+"\n", top+marginT+plotH/2)
+
+		// Break-even.
+		s.line(marginL, py(0), marginL+plotW, py(0), `stroke="black" stroke-dasharray="4,4"`)
+		s.text(marginL+plotW-4, py(0)-4, "end", "break-even")
+
+		// Lines and legend.
+		for j, line := range lines {
+			color := palette[j%len(palette)]
+			var pts []string
+			for _, p := range line {
+				pts = append(pts, fmt.Sprintf("%.1f,%.1f", px(p.x), py(p.y)))
+			}
+			s.printf(`<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`+"\n", strings.Join(pts, " "), color)
+			ly := top + marginT + 10 + float64(j)*18
+			s.line(marginL+plotW+15, ly, marginL+plotW+35, ly, fmt.Sprintf(`stroke="%s" stroke-width="2"`, color))
+			s.text(marginL+plotW+40, ly+4, "start", scenarios[j].Name)
+		}
+	}
+	s.end()
+}
+
+// plotHeatmaps draws a heatmap of ∆CPU% over the grid swept by x and y for
+// each application and scenario, with applications in rows and scenarios
+// in columns. Cells that save CPU are blue, and those that cost CPU are
+// red. Break-even runs between cells of opposite sign.
+func plotHeatmaps(s *svg, apps []AppProfile, scenarios []Scenario, x, y *VaryProgram) {
+	// Compute every grid first, to share a color scale.
+	type grid struct {
+		xs, ys []float64
+		vals   [][]float64 // Indexed by x, then y.
+	}
+	grids := make([][]grid, len(apps))
+	maxAbs := 0.0
+	for i, app := range apps {
+		for _, scenario := range scenarios {
+			var g grid
+			for scenario := range x.sweep(scenario) {
+				g.xs = append(g.xs, axisValue(x, scenario))
+				var col []float64
+				g.ys = g.ys[:0]
+				for scenario := range y.sweep(scenario) {
+					g.ys = append(g.ys, axisValue(y, scenario))
+					v := deltaCPUFrac(app, scenario) * 100
+					col = append(col, v)
+					maxAbs = max(maxAbs, math.Abs(v))
+				}
+				g.vals = append(g.vals, col)
+			}
+			grids[i] = append(grids[i], g)
+		}
+	}
+	if maxAbs == 0 {
+		maxAbs = 1
+	}
+
+	s.begin(panelW*len(scenarios), panelH*len(apps)+40)
+	plotColorScale(s, maxAbs)
+	for i, app := range apps {
+		for j, g := range grids[i] {
+			left := float64(panelW * j)
+			top := float64(panelH*i + 40)
+			nx, ny := len(g.vals), len(g.ys)
+			cw, ch := float64(plotW)/float64(nx), float64(plotH)/float64(ny)
+			cx := func(k int) float64 { return left + marginL + float64(k)*cw }
+			cy := func(k int) float64 { return top + marginT + plotH - float64(k+1)*ch }
+
+			s.text(left+marginL+plotW/2, top+marginT-15, "middle", app.Name+" / "+scenarios[j].Name)
+			for k, col := range g.vals {
+				for l, v := range col {
+					s.printf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%.2f%%</title></rect>`+"\n", cx(k), cy(l), cw, ch, heatColor(v/maxAbs), v)
+				}
+			}
+			// Break-even between neighbors of opposite sign.
+			const edge = `stroke="black" stroke-width="2"`
+			for k, col := range g.vals {
+				for l, v := range col {
+					if k+1 < nx && (v < 0) != (g.vals[k+1][l] < 0) {
+						s.line(cx(k+1), cy(l), cx(k+1), cy(l)+ch, edge)
+					}
+					if l+1 < ny && (v < 0) != (col[l+1] < 0) {
+						s.line(cx(k), cy(l), cx(k)+cw, cy(l), edge)
+					}
+				}
+			}
+			s.printf(`<rect x="%.1f" y="%.1f" width="%d" height="%d" fill="none" stroke="black"/>`+"\n", left+marginL, top+marginT, plotW, plotH)
+
+			// Label a few cells along each axis.
+			for _, k := range labeledCells(nx) {
+				s.text(cx(k)+cw/2, top+marginT+plotH+18, "middle", fmt.Sprintf("%.3g", g.xs[k]))
+			}
+			for _, l := range labeledCells(ny) {
+				s.text(left+marginL-8, cy(l)+ch/2+4, "end", fmt.Sprintf("%.3g", g.ys[l]))
+			}
+			s.text(left+marginL+plotW/2, top+marginT+plotH+40, "middle", axisLabel(x))
+			s.printf(`<text transform="translate(%.1f,%.1f) rotate(-90)" text-anchor="middle">%s</text>`+"\n", left+15, top+marginT+plotH/2, html.EscapeString(axisLabel(y)))
+		}
+	}
+	s.end()
+}
+
+// labeledCells returns the indexes of up to 6 evenly spaced cells out of
+// n, including the first and last.
+func labeledCells(n int) []int {
+	var cells []int
+	if n <= 6 {
+		for i := range n {
+			cells = append(cells, i)
+		}
+		return cells
+	}
+	for _, t := range ticks(0, float64(n-1), 6) {
+		cells = append(cells, int(math.Round(t)))
+	}
+	return cells
+}
+
+// plotColorScale draws the heatmap color scale across the top.
+func plotColorScale(s *svg, maxAbs float64) {
+	const n, w = 11, 30
+	for i, t := range ticks(-1, 1, n) {
+		s.printf(`<rect x="%d" y="10" width="%d" height="14" fill="%s"/>`+"\n", marginL+i*w, w, heatColor(t))
+	}
+	s.text(marginL, 38, "start", fmt.Sprintf("%.2f%%", -maxAbs))
+	s.text(marginL+n*w/2, 38, "middle", "0%")
+	s.text(marginL+n*w, 38, "end", fmt.Sprintf("%+.2f%%", maxAbs))
+	s.text(marginL+n*w+10, 22, "start", "∆CPU%")
+}
+
+// heatColor returns the color for t in [-1, 1]: blue for negative, red for
+// positive and white for 0.
+func heatColor(t float64) string {
+	r, g, b := 178.0, 24.0, 43.0
+	if t < 0 {
+		r, g, b = 33, 102, 172
+	}
+	t = min(math.Abs(t), 1)
+	mix := func(c float64) int { return int(math.Round(255*(1-t) + c*t)) }
+	return fmt.Sprintf("#%02x%02x%02x", mix(r), mix(g), mix(b))
+}
@@ -4,7 +4,11 @@
 
 package main
 
-import "time"
+import (
+	"time"
+
+	"github.com/mknyszek/region-eval/cpusim"
+)
 
 type AppProfile struct {
 	Name          string
@@ -13,32 +17,200 @@ type AppProfile struct {
 	AllocBytes    uint64
 	Allocs        uint64
 	PointerWrites uint64
+
+	// MarkPointerWrites is the number of PointerWrites made while the
+	// GC was marking, which already take Go's write barrier. If it's
+	// unknown, it's zero, and every write is charged the always-on
+	// region barrier check. It's estimated from the ptrcount gctraces
+	// with scripts/mark_pointer_writes.py, which assumes writes are
+	// spread evenly over time, so it's only an approximation.
+	MarkPointerWrites uint64
+
+	// WriteMix optionally breaks PointerWrites down by kind, as
+	// measured with regions in use. Without it, the fraction of writes
+	// that take the region path through the write barrier is assumed
+	// to be the scenario's RegionAllocsFrac.
+	WriteMix *WriteMix
+
+	// AssistCPU is the part of GCCPU spent in mark assists, which
+	// delay the goroutines that have to do them.
+	AssistCPU time.Duration
+
+	// Latency is the application's baseline request latency, if it
+	// has requests.
+	Latency *Latency
+
+	// Benchmark is the name of the benchmark the profile comes from, as
+	// in its results, without the -GOMAXPROCS suffix. Ops is the number
+	// of operations it did, or zero if it doesn't have any, and
+	// OpsPerSec its throughput.
+	Benchmark string
+	Ops       uint64
+	OpsPerSec float64
+
+	// Components are the processes that make up the application, if
+	// there's more than one, each with its own counters. The counters
+	// of the application as a whole are their totals, and are filled
+	// in by aggregate.
+	Components []AppProfile
 }
 
+// aggregate sets p's counters to the totals of its components, if it has
+// any. TotalCPU of each component is its GOMAXPROCS times its lifetime.
+func (p *AppProfile) aggregate() {
+	if len(p.Components) == 0 {
+		return
+	}
+	var mix WriteMix
+	haveMix := true
+	for _, c := range p.Components {
+		p.TotalCPU += c.TotalCPU
+		p.GCCPU += c.GCCPU
+		p.AssistCPU += c.AssistCPU
+		p.AllocBytes += c.AllocBytes
+		p.Allocs += c.Allocs
+		p.PointerWrites += c.PointerWrites
+		p.MarkPointerWrites += c.MarkPointerWrites
+		if c.WriteMix == nil {
+			haveMix = false
+			continue
+		}
+		for k, frac := range c.WriteMix {
+			mix[k] += frac * float64(c.PointerWrites)
+		}
+	}
+	if haveMix && p.PointerWrites != 0 {
+		for k := range mix {
+			mix[k] /= float64(p.PointerWrites)
+		}
+		p.WriteMix = &mix
+	}
+}
+
+func init() {
+	for i := range AppProfiles {
+		AppProfiles[i].aggregate()
+	}
+}
+
+// Latency describes an application's request latency.
+type Latency struct {
+	P50, P99 time.Duration
+	Servers  int // Requests served in parallel, i.e. GOMAXPROCS.
+
+	// Utilization is the average fraction of Servers that are busy.
+	// If it's zero, -utilization is used.
+	Utilization float64
+}
+
+// WriteMix is the fraction of pointer writes of each cpusim.WriteKind.
+// The fractions sum to 1.
+type WriteMix [cpusim.NumWriteKinds]float64
+
 var AppProfiles = []AppProfile{
 	{
-		Name:          "Tile38",
-		TotalCPU:      time.Duration(1055.508 * 1e9),
-		GCCPU:         time.Duration(106033 * 1e6),
-		Allocs:        145783906,
-		AllocBytes:    84299344536,
-		PointerWrites: 3982888311,
+		Name:              "Tile38",
+		TotalCPU:          time.Duration(1055.508 * 1e9),
+		GCCPU:             time.Duration(106033 * 1e6),
+		Allocs:            145783906,
+		AllocBytes:        84299344536,
+		PointerWrites:     3982888311,
+		MarkPointerWrites: 968867916,
+		AssistCPU:         time.Duration(2665.7 * 1e6), // Assists are 2.51% of GC CPU in data/tile38/baseline.results.
+		Latency: &Latency{
+			P50:     218800,
+			P99:     5384109,
+			Servers: 4,
+		},
+		Benchmark: "BenchmarkTile38QueryLoad",
+		Ops:       2000000,
+		OpsPerSec: 22084,
 	},
 	{
-		Name:          "etcd Put",
-		TotalCPU:      time.Duration(4.683 * 4 * 1e9),
-		GCCPU:         time.Duration(310.651 * 1e6),
-		Allocs:        8838440,
-		AllocBytes:    1027291400,
-		PointerWrites: 38108457,
+		Name: "etcd Put",
+		Components: []AppProfile{
+			{
+				Name:              "infra1",
+				TotalCPU:          time.Duration(4.683 * 4 * 1e9),
+				GCCPU:             time.Duration(310.651 * 1e6),
+				Allocs:            8838440,
+				AllocBytes:        1027291400,
+				PointerWrites:     38108457,
+				MarkPointerWrites: 3993359,
+				AssistCPU:         time.Duration(108.907 * 1e6),
+			},
+			{
+				Name:              "infra2",
+				TotalCPU:          time.Duration(5.795 * 4 * 1e9),
+				GCCPU:             time.Duration(288.744 * 1e6),
+				Allocs:            7382365,
+				AllocBytes:        870544320,
+				PointerWrites:     28608146,
+				MarkPointerWrites: 2215641,
+				AssistCPU:         time.Duration(79.498 * 1e6),
+			},
+			{
+				Name:              "infra3",
+				TotalCPU:          time.Duration(4.554 * 4 * 1e9),
+				GCCPU:             time.Duration(286.083 * 1e6),
+				Allocs:            7417702,
+				AllocBytes:        870388072,
+				PointerWrites:     28574554,
+				MarkPointerWrites: 2233293,
+				AssistCPU:         time.Duration(79.961 * 1e6),
+			},
+		},
+		Latency: &Latency{
+			P50:     16019418,
+			P99:     163016958,
+			Servers: 4,
+		},
+		Benchmark: "BenchmarkEtcdPut",
+		Ops:       100000,
+		OpsPerSec: 51722,
 	},
 	{
-		Name:          "etcd STM",
-		TotalCPU:      time.Duration(13.303 * 4 * 1e9),
-		GCCPU:         time.Duration(4677.1 * 1e6),
-		Allocs:        51522979,
-		AllocBytes:    11645083144,
-		PointerWrites: 446980825,
+		Name: "etcd STM",
+		Components: []AppProfile{
+			{
+				Name:              "infra1",
+				TotalCPU:          time.Duration(13.303 * 4 * 1e9),
+				GCCPU:             time.Duration(4677.1 * 1e6),
+				Allocs:            51522979,
+				AllocBytes:        11645083144,
+				PointerWrites:     446980825,
+				MarkPointerWrites: 103406115,
+				AssistCPU:         time.Duration(1630.02 * 1e6),
+			},
+			{
+				Name:              "infra2",
+				TotalCPU:          time.Duration(13.312 * 4 * 1e9),
+				GCCPU:             time.Duration(4810.581 * 1e6),
+				Allocs:            50059259,
+				AllocBytes:        11952261448,
+				PointerWrites:     461119353,
+				MarkPointerWrites: 110064894,
+				AssistCPU:         time.Duration(1658.946 * 1e6),
+			},
+			{
+				Name:              "infra3",
+				TotalCPU:          time.Duration(13.278 * 4 * 1e9),
+				GCCPU:             time.Duration(4534.154 * 1e6),
+				Allocs:            51170590,
+				AllocBytes:        11562181088,
+				PointerWrites:     443182626,
+				MarkPointerWrites: 103143425,
+				AssistCPU:         time.Duration(1530.634 * 1e6),
+			},
+		},
+		Latency: &Latency{
+			P50:     80652869,
+			P99:     454921100,
+			Servers: 4,
+		},
+		Benchmark: "BenchmarkEtcdSTM",
+		Ops:       99999,
+		OpsPerSec: 9320,
 	},
 	{
 		Name:          "CockroachDB 300 kv0",
@@ -0,0 +1,92 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Fleet describes how applications are deployed, to turn CPU changes into
+// cores and dollars.
+type Fleet struct {
+	CoreHourCost      float64 // Dollars per core-hour.
+	UtilizationTarget float64 // Average fraction of provisioned cores in use.
+
+	// Cores is the number of cores each application uses on average,
+	// by AppProfile name. Applications that aren't listed are left out.
+	Cores map[string]float64
+}
+
+const hoursPerYear = 365 * 24
+
+// loadFleet reads a JSON Fleet from path.
+func loadFleet(path string) (*Fleet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fleet Fleet
+	if err := json.Unmarshal(data, &fleet); err != nil {
+		return nil, fmt.Errorf("parsing fleet %s: %v", path, err)
+	}
+	if fleet.UtilizationTarget <= 0 || fleet.UtilizationTarget > 1 {
+		return nil, fmt.Errorf("fleet %s: UtilizationTarget must be in (0, 1], got %v", path, fleet.UtilizationTarget)
+	}
+	return &fleet, nil
+}
+
+// provisioned returns the number of cores provisioned for app, or 0 if
+// it's not in the fleet.
+func (f *Fleet) provisioned(app AppProfile) float64 {
+	return f.Cores[app.Name] / f.UtilizationTarget
+}
+
+// writeSavings writes the cores and dollars each scenario saves for each
+// application in the fleet, followed by the whole portfolio of those
+// applications. Negative savings are losses.
+//
+// Provisioning is assumed to scale with CPU use, keeping the utilization
+// target, so cores saved are the provisioned cores times the CPU saved.
+func writeSavings(t *table, fleet *Fleet, apps []AppProfile, scenarios []Scenario, varyProg *VaryProgram) {
+	var params []string
+	if varyProg != nil {
+		params = varyProg.Params()
+	}
+	t.header(append(append([]string{"Application", "Scenario"}, params...), "Cores", "∆CPU%", "Cores Saved", "$/yr Saved")...)
+	for _, scenario := range scenarios {
+		row := func(name string, cores, cpuFrac float64) {
+			cells := []string{name, scenario.Name}
+			for _, p := range params {
+				cells = append(cells, fmt.Sprintf("%.3f", *param2Extractor[p](&scenario)))
+			}
+			saved := -cores * cpuFrac
+			t.row(append(cells,
+				fmt.Sprintf("%.0f", cores),
+				fmt.Sprintf("%+.2f%%", cpuFrac*100),
+				fmt.Sprintf("%+.1f", saved),
+				fmt.Sprintf("%+.0f", saved*fleet.CoreHourCost*hoursPerYear),
+			)...)
+		}
+
+		// The portfolio's CPU change is the average of its
+		// applications', weighted by deployment.
+		var total, totalDelta float64
+		for _, app := range apps {
+			cores := fleet.provisioned(app)
+			if cores == 0 {
+				continue
+			}
+			cpuFrac := deltaCPUFrac(app, scenario)
+			row(app.Name, cores, cpuFrac)
+			total += cores
+			totalDelta += cores * cpuFrac
+		}
+		if total != 0 {
+			row("Portfolio", total, totalDelta/total)
+		}
+	}
+}
@@ -4,7 +4,16 @@
 
 package main
 
-import "time"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mknyszek/region-eval/cpusim"
+	"github.com/mknyszek/region-eval/cpusim/trace"
+)
 
 var Scenarios = []Scenario{
 	{
@@ -51,6 +60,39 @@ type Scenario struct {
 
 }
 
+// measureScenario replays the allocation trace at path through cpusim and
+// returns the resulting scenario, named after the trace file.
+//
+// Scanning isn't simulated, so ScannedRegionAllocBytesFrac and
+// RegionScanCostRatio aren't measured. They're set to scannedFrac and
+// scanCostRatio instead, and the scenario's name says so.
+func measureScenario(path string, scannedFrac, scanCostRatio float64) (Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	defer f.Close()
+	tr, err := trace.NewReader(f)
+	if err != nil {
+		return Scenario{}, fmt.Errorf("reading trace %s: %v", path, err)
+	}
+	r := trace.NewReplayer(cpusim.NewAllocator(nil))
+	if err := r.Replay(tr); err != nil {
+		return Scenario{}, fmt.Errorf("replaying trace %s: %v", path, err)
+	}
+	p := r.Scenario()
+	return Scenario{
+		Name:                        fmt.Sprintf("Measured:%s(assumed:B_S=%v,C_R=%v)", strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), scannedFrac, scanCostRatio),
+		RegionAllocBytesFrac:        p.RegionAllocBytesFrac,
+		RegionAllocsFrac:            p.RegionAllocsFrac,
+		FadeAllocBytesFrac:          p.FadeAllocBytesFrac,
+		FadeAllocsFrac:              p.FadeAllocsFrac,
+		ScannedRegionAllocBytesFrac: scannedFrac,
+		RegionScanCostRatio:         scanCostRatio,
+		FadeAllocsPointerDensity:    p.FadeAllocsPointerDensity,
+	}, nil
+}
+
 func deltaCPUFrac(prof AppProfile, scenario Scenario) float64 {
 	return float64(prof.TotalCPU+deltaCPU(prof, scenario))/float64(prof.TotalCPU) - 1.0
 }
@@ -61,15 +103,12 @@ func deltaCPU(prof AppProfile, scenario Scenario) time.Duration {
 	// Change in alloc costs.
 	d += deltaAllocCPU(prof, scenario)
 
-	// Reduced GC cost.
-	d += time.Duration(float64(prof.GCCPU) * (1 - scenario.RegionAllocBytesFrac))
-	// GC cost of scanning region memory.
-	d += time.Duration(float64(prof.GCCPU) * scenario.RegionAllocBytesFrac * (scenario.FadeAllocBytesFrac + scenario.ScannedRegionAllocBytesFrac) * scenario.RegionScanCostRatio)
-	// Subtract original full base GC cost.
-	d -= prof.GCCPU
+	// Change in GC costs.
+	d += deltaGCCPU(prof, scenario)
 
 	// New write barrier (overestimate).
-	d += wbTestCPU(scenario.RegionAllocsFrac, prof.PointerWrites)
+	d += wbCheckCPU(prof)
+	d += wbCPU(prof, scenario)
 
 	// Fade cost.
 	d += fadeCPU(
@@ -79,6 +118,18 @@ func deltaCPU(prof AppProfile, scenario Scenario) time.Duration {
 	return d
 }
 
+func deltaGCCPU(prof AppProfile, scenario Scenario) time.Duration {
+	var d time.Duration
+
+	// Reduced GC cost.
+	d += time.Duration(float64(prof.GCCPU) * (1 - scenario.RegionAllocBytesFrac))
+	// GC cost of scanning region memory.
+	d += time.Duration(float64(prof.GCCPU) * scenario.RegionAllocBytesFrac * (scenario.FadeAllocBytesFrac + scenario.ScannedRegionAllocBytesFrac) * scenario.RegionScanCostRatio)
+	// Subtract original full base GC cost.
+	d -= prof.GCCPU
+	return d
+}
+
 func deltaAllocCPU(prof AppProfile, scenario Scenario) time.Duration {
 	var d time.Duration
 
@@ -98,17 +149,43 @@ func deltaAllocCPU(prof AppProfile, scenario Scenario) time.Duration {
 }
 
 func bumpAllocCPU(o, b uint64) time.Duration {
-	return time.Duration(8*float64(o) + 0.15*float64(b))
+	return time.Duration(costs.BumpAllocPerObject*float64(o) + costs.BumpAllocPerByte*float64(b))
 }
 
 func baseAllocCPU(o, b uint64) time.Duration {
 	return time.Duration(20*float64(o) + 0.08*float64(b))
 }
 
+// wbCheckCPU returns the cost of the always-on region write barrier check
+// for prof's pointer writes. Writes made while the GC is marking already
+// take Go's write barrier, which can do the check for free. This cost
+// doesn't depend on how much regions are used.
+func wbCheckCPU(prof AppProfile) time.Duration {
+	if prof.MarkPointerWrites >= prof.PointerWrites {
+		return 0
+	}
+	return time.Duration(costs.WBCheckPerWrite * float64(prof.PointerWrites-prof.MarkPointerWrites))
+}
+
+// wbCPU returns the cost of the region write barrier test for all of
+// prof's pointer writes. Each kind of write in prof's WriteMix is charged
+// its own cost; without a WriteMix, writes of pointers into regions are
+// assumed to be in proportion to region-allocated objects.
+func wbCPU(prof AppProfile, scenario Scenario) time.Duration {
+	if prof.WriteMix == nil {
+		return wbTestCPU(scenario.RegionAllocsFrac, prof.PointerWrites)
+	}
+	var d float64
+	for k, frac := range prof.WriteMix {
+		d += costs.wbTest(cpusim.WriteKind(k)) * frac * float64(prof.PointerWrites)
+	}
+	return time.Duration(d)
+}
+
 func wbTestCPU(enabledFrac float64, writes uint64) time.Duration {
-	return time.Duration(5.2 * enabledFrac * float64(writes))
+	return time.Duration(costs.WBTestPerWrite * enabledFrac * float64(writes))
 }
 
 func fadeCPU(o, p uint64) time.Duration {
-	return time.Duration(40*float64(o) + 3.37*float64(p))
+	return time.Duration(costs.FadePerObject*float64(o) + costs.FadePerPointer*float64(p))
 }
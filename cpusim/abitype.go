@@ -0,0 +1,115 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// abiType mirrors the prefix of internal/abi.Type that we need.
+type abiType struct {
+	Size_       uintptr
+	PtrBytes    uintptr
+	Hash        uint32
+	TFlag       uint8
+	Align_      uint8
+	FieldAlign_ uint8
+	Kind_       uint8
+	Equal       unsafe.Pointer
+	GCData      *byte
+}
+
+// tflagGCMaskOnDemand mirrors internal/abi.TFlagGCMaskOnDemand. If it is
+// set, GCData is really a **byte, and the runtime builds the bitmask on
+// first use.
+const tflagGCMaskOnDemand = 1 << 4
+
+// abiTypeOf returns the runtime's type descriptor for t.
+func abiTypeOf(t reflect.Type) *abiType {
+	// A reflect.Type is always a *reflect.rtype, which wraps an abi.Type.
+	return (*abiType)((*[2]unsafe.Pointer)(unsafe.Pointer(&t))[1])
+}
+
+// runtimeGCMask returns the runtime's pointer bitmask for t, or nil if
+// the runtime hasn't built it yet.
+func (t *abiType) runtimeGCMask() *byte {
+	if t.TFlag&tflagGCMaskOnDemand == 0 {
+		return t.GCData
+	}
+	p := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(t.GCData)))
+	if p == nil || uintptr(p)&(ptrSize-1) != 0 {
+		// Not built, or being built right now.
+		return nil
+	}
+	return (*byte)(p)
+}
+
+// FakeTypeOf returns a FakeType with the same size and pointer bitmap as
+// the runtime's type descriptor for t.
+//
+// The FakeType is the one FakeFromReflect derives from t, checked against
+// the runtime's type descriptor. FakeTypeOf panics if they disagree, since
+// that means either FakeFromReflect is wrong or abiType no longer matches
+// internal/abi.Type. If the runtime builds the bitmap for t lazily and
+// hasn't done so yet, FakeTypeOf runs a GC to get it built, and panics if
+// that doesn't work either, since then there's nothing to check against.
+func FakeTypeOf(t reflect.Type) *FakeType {
+	derived := FakeFromReflect(t)
+	if err := checkAgainstRuntime(derived, t); err != nil {
+		panic(err)
+	}
+	return derived
+}
+
+// checkAgainstRuntime checks that typ has the same size and pointers as
+// the runtime's type descriptor for t.
+func checkAgainstRuntime(typ *FakeType, t reflect.Type) error {
+	rt := abiTypeOf(t)
+	if rt.Size_ != t.Size() {
+		return fmt.Errorf("type %v: runtime size %d doesn't match reflect size %d", t, rt.Size_, t.Size())
+	}
+	if typ.Size_ != bitmath.AlignUp(rt.Size_, ptrSize) || typ.PtrBytes != rt.PtrBytes {
+		return fmt.Errorf("type %v: size %d and ptrBytes %d, runtime has %d and %d", t, typ.Size_, typ.PtrBytes, rt.Size_, rt.PtrBytes)
+	}
+	if rt.PtrBytes == 0 {
+		return nil
+	}
+	gcdata := rt.runtimeGCMask()
+	if gcdata == nil {
+		buildRuntimeGCMask(t)
+		if gcdata = rt.runtimeGCMask(); gcdata == nil {
+			return fmt.Errorf("type %v: runtime didn't build its pointer bitmap, so it can't be checked", t)
+		}
+	}
+	nwords := rt.PtrBytes / ptrSize
+	want := slices.Clone(unsafe.Slice(gcdata, (nwords+7)/8))
+	if nwords%8 != 0 {
+		// Ignore bits past PtrBytes.
+		want[len(want)-1] &= 1<<(nwords%8) - 1
+	}
+	got := unsafe.Slice(typ.GCData, (nwords+7)/8)
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("type %v: pointer bitmap %x, runtime has %x", t, got, want)
+	}
+	return nil
+}
+
+// gcMaskSink keeps an object alive for buildRuntimeGCMask.
+var gcMaskSink any
+
+// buildRuntimeGCMask gets the runtime to build its pointer bitmap for t,
+// if it does so lazily, by having the GC scan an object of type t.
+func buildRuntimeGCMask(t reflect.Type) {
+	gcMaskSink = reflect.New(t).Interface()
+	runtime.GC()
+	gcMaskSink = nil
+}
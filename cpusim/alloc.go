@@ -5,84 +5,178 @@
 package cpusim
 
 import (
-	"math/bits"
 	"unsafe"
 
 	"github.com/mknyszek/region-eval/cpusim/bitmath"
 )
 
-const (
-	BlockSize  = 8 << 10
-	lineSize   = 128
-	headerSize = unsafe.Sizeof(uint64(0))
-	minAlign   = 8
-	BitmapSize = BlockSize / minAlign / 8
-)
-
-func init() {
-	if BitmapSize != lineSize {
-		panic("each block bitmap must fit exactly in one line")
-	}
-}
-
+// Pointer is the address of an object in region memory.
+//
+// Unlike a pointer into the Go heap, a Pointer doesn't keep the memory it
+// points to alive. Region memory belongs to the Block it's in, and once
+// the Block is unreachable, its memory is reused for new blocks. Objects
+// allocated by an Allocator live as long as the Allocator, or until it's
+// reset.
 type Pointer unsafe.Pointer
 
 type Allocator struct {
 	main     *Block
 	overflow *Block
 	full     *Block
+	large    *Block
 	existing []*Block
+
+	// Counters for Stats.
+	overflowAllocs uint64
+	overflowBlocks uint64
+	largeAllocs    uint64
 }
 
+// NewAllocator returns an allocator that allocates from blocks before
+// making new ones. The allocator owns its blocks, and keeps them alive
+// for as long as it's reachable itself.
 func NewAllocator(blocks []*Block) *Allocator {
 	return &Allocator{existing: blocks}
 }
 
+// Make allocates a zeroed object of the given size and type.
+//
+// The object is aligned to typ.Align_, if that's stricter than minAlign.
+// Any padding needed for alignment goes before the object's header, if
+// it has one, so ObjBits still marks the start of the object.
 func (a *Allocator) Make(size uintptr, typ *FakeType) Pointer {
-	if a.main == nil {
-		a.main = a.getBlock()
+	if headerSize == 0 && size == 0 {
+		// Without a header, zero-sized objects would all start at the
+		// same address. Give them a word.
+		size = minAlign
 	}
+	// Escape bits and ObjBits have a bit per minAlign bytes, so objects
+	// must cover whole granules. On 32-bit platforms, sizes that are a
+	// whole number of words might not.
+	size = bitmath.AlignUp(size, minAlign)
+	h := makeObjHeader(typ, size)
 	fullSize := size
 	fullSize += headerSize
 	fullSize = bitmath.AlignUp(fullSize, minAlign)
+	align := typ.align()
+	if fullSize+align-minAlign > maxSmallSize {
+		return a.makeLarge(size, typ)
+	}
+	if a.main == nil {
+		a.main = a.getBlock()
+	}
 	var addr unsafe.Pointer
 outerLoop:
 	for {
-		if addr = a.main.tryAlloc(fullSize); addr != nil {
+		if addr = a.main.tryAlloc(fullSize, align, h); addr != nil {
 			break
 		}
 		if fullSize > lineSize && a.main.limit-a.main.cursor > lineSize {
 			if a.overflow == nil {
-				a.overflow = NewBlock(0)
+				a.overflow = NewBlock(LineMask{})
+				a.overflowBlocks++
 			}
 			for {
-				if addr = a.overflow.tryAlloc(fullSize); addr != nil {
+				if addr = a.overflow.tryAlloc(fullSize, align, h); addr != nil {
+					a.overflowAllocs++
 					break outerLoop
 				}
-				a.overflow = NewBlock(0)
+				a.overflow.next = a.full
+				a.full = a.overflow
+				a.overflow = NewBlock(LineMask{})
+				a.overflowBlocks++
 			}
 		}
 		a.main.next = a.full
 		a.full = a.main
 		a.main = a.getBlock()
 	}
-	*(*uint64)(addr) = uint64(uintptr(unsafe.Pointer(typ))) | (uint64(size/8) << 48)
-	memclrNoHeapPointers(unsafe.Add(addr, headerSize), size)
-	return Pointer(unsafe.Add(addr, headerSize))
+	memclrNoHeapPointers(addr, size)
+	return Pointer(addr)
+}
+
+// ResetStats describes the work done by a single Allocator reset.
+type ResetStats struct {
+	BlocksRecycled    int // Blocks returned to the free list.
+	LinesPinned       int // Lines in recycled blocks kept back by escaped objects.
+	LargeBlocksFreed  int // Large object blocks released.
+	LargeBlocksPinned int // Large object blocks kept back by escaped objects.
 }
 
-func (a *Allocator) Reset() {
+// Reset frees all memory allocated by the allocator, except for escaped
+// objects. All blocks are returned to the free list for reuse, but lines
+// containing escaped objects remain pinned and are skipped by future
+// allocations.
+func (a *Allocator) Reset() ResetStats {
+	return a.reset(false)
+}
+
+// ResetEvacuated is like Reset, but assumes that all escaped objects have
+// been evacuated out of the allocator's memory. Escape state is cleared,
+// so no lines remain pinned.
+func (a *Allocator) ResetEvacuated() ResetStats {
+	return a.reset(true)
+}
+
+func (a *Allocator) reset(evacuated bool) ResetStats {
+	if debugVerify {
+		if err := a.Verify(); err != nil {
+			panic(err)
+		}
+	}
+	var stats ResetStats
+	if evacuated {
+		// Blocks on the free list may still have lines pinned by
+		// objects that escaped before an earlier Reset. Those have
+		// been evacuated too.
+		for _, b := range a.existing {
+			d := b.Meta()
+			if d.LineEscape.IsZero() {
+				continue
+			}
+			d.EscBits = [BitmapSize / 8]uint64{}
+			d.LineEscape = LineMask{}
+			b.Reset()
+		}
+	}
+	recycle := func(b *Block) {
+		d := b.Meta()
+		if evacuated {
+			d.EscBits = [BitmapSize / 8]uint64{}
+			d.LineEscape = LineMask{}
+		}
+		stats.BlocksRecycled++
+		stats.LinesPinned += d.LineEscape.Count()
+		b.Reset()
+		b.next = nil
+		a.existing = append(a.existing, b)
+	}
+	if a.main != nil {
+		recycle(a.main)
+		a.main = nil
+	}
+	if a.overflow != nil {
+		recycle(a.overflow)
+		a.overflow = nil
+	}
 	for a.full != nil {
-		a.full.Reset()
-		a.existing = append(a.existing, a.full)
-		a.full = a.full.next
+		b := a.full
+		a.full = b.next
+		recycle(b)
 	}
+	a.resetLarge(evacuated, &stats)
+	if debugVerify {
+		if err := a.Verify(); err != nil {
+			panic(err)
+		}
+	}
+	return stats
 }
 
 func (a *Allocator) getBlock() *Block {
 	n := len(a.existing)
 	if n == 0 {
-		return NewBlock(0)
+		return NewBlock(LineMask{})
 	}
 	b := a.existing[n-1]
 	a.existing = a.existing[:n-1]
@@ -90,51 +184,71 @@ func (a *Allocator) getBlock() *Block {
 }
 
 func (a *Allocator) BlockOf(ptr Pointer) *Block {
-	if a.main.Contains(ptr) {
+	if a.main != nil && a.main.Contains(ptr) {
 		return a.main
 	}
-	if a.overflow.Contains(ptr) {
+	if a.overflow != nil && a.overflow.Contains(ptr) {
 		return a.overflow
 	}
-	f := a.full
-	for f != nil {
-		if f.Contains(ptr) {
-			return f
+	for _, list := range []*Block{a.full, a.large} {
+		for f := list; f != nil; f = f.next {
+			if f.Contains(ptr) {
+				return f
+			}
 		}
-		f = f.next
 	}
 	return nil
 }
 
 type Block struct {
 	cursor, limit uintptr
-	lineAlloc     uint64
+	lineAlloc     LineMask
 	next          *Block
 	data          *[BlockSize]byte
+
+	// nblocks is the number of contiguous BlockSize chunks backing
+	// this block. large is true if the block holds exactly one large
+	// object; see makeLarge. Only large blocks have nblocks > 1.
+	nblocks uintptr
+	large   bool
+
+	// refills is the number of times refill found a new range of
+	// free lines.
+	refills uint64
 }
 
-func NewBlock(lines uint64) *Block {
+// NewBlock returns a new block with the given lines pinned. Its memory is
+// reused once the block is unreachable, whether or not any Pointers into
+// it are still around.
+func NewBlock(lines LineMask) *Block {
 	blk := new(Block)
-	blk.data = new([BlockSize]byte)
+	blk.data = allocChunks(1, false)
+	blk.nblocks = 1
 	d := (*BlockMeta)(unsafe.Pointer(&blk.data[0]))
 	d.LineEscape = lines
 	blk.Reset()
+	registerBlock(blk, true)
 	return blk
 }
 
-func NewBlockFromExisting(lines uint64, region uintptr, data *[BlockSize]byte) *Block {
+// NewBlockFromExisting returns a block backed by data, which must be
+// BlockSize-aligned. The arena containing data is marked as a region
+// arena, so it must not hold anything other than blocks.
+func NewBlockFromExisting(lines LineMask, region uintptr, data *[BlockSize]byte) *Block {
 	blk := new(Block)
 	blk.data = data
+	blk.nblocks = 1
 	d := (*BlockMeta)(unsafe.Pointer(&blk.data[0]))
 	d.LineEscape = lines
-	d.Region = region
+	d.Region = uint64(region)
 	blk.Reset()
+	registerBlock(blk, false)
 	return blk
 }
 
 func (b *Block) Contains(ptr Pointer) bool {
 	s := uintptr(unsafe.Pointer(&b.data[0]))
-	e := uintptr(unsafe.Pointer(&b.data[len(b.data)-1]))
+	e := s + b.nblocks*BlockSize - 1
 	p := uintptr(ptr)
 	return s <= p && p <= e
 }
@@ -143,80 +257,71 @@ func (b *Block) Base() uintptr {
 	return uintptr(unsafe.Pointer(&b.data[0]))
 }
 
-func (b *Block) tryAlloc(size uintptr) unsafe.Pointer {
-	if addr := b.tryAllocFast(size); addr != nil {
-		return addr
-	}
-	return b.tryAlloc1(size)
+// at returns address p, which must be in b's memory, as a pointer.
+func (b *Block) at(p uintptr) unsafe.Pointer {
+	return unsafe.Add(unsafe.Pointer(b.data), p-b.Base())
 }
 
-func (b *Block) tryAllocFast(size uintptr) unsafe.Pointer {
-	c := b.cursor
-	n := c + size
-	if n < b.limit {
-		b.cursor = n
-		wi := (c - b.Base()) / minAlign
-		b.data[BitmapSize+wi/8] |= 1 << (wi % 8)
-		return unsafe.Pointer(c)
+// tryAlloc allocates size bytes in b for an object with header h, and
+// records the header wherever the layout keeps it. It returns the address
+// of the object.
+func (b *Block) tryAlloc(size, align uintptr, h objHeader) unsafe.Pointer {
+	if align > minAlign {
+		return b.tryAllocAligned(size, align, h)
 	}
-	return nil
+	if addr := b.tryAllocFast(size, h); addr != nil {
+		return addr
+	}
+	return b.tryAlloc1(size, h)
 }
 
-func (b *Block) tryAlloc1(size uintptr) unsafe.Pointer {
+func (b *Block) tryAlloc1(size uintptr, h objHeader) unsafe.Pointer {
 	for {
 		if !b.refill() {
 			return nil
 		}
-		if addr := b.tryAllocFast(size); addr != nil {
+		if addr := b.tryAllocFast(size, h); addr != nil {
 			return addr
 		}
 	}
 }
 
 func (b *Block) refill() bool {
-	lineAlloc := b.lineAlloc
-	i := bits.TrailingZeros64(^lineAlloc)
-	if i == 64 {
+	i := b.lineAlloc.next(0, false)
+	if i >= linesPerBlock {
 		return false
 	}
-	n := bits.TrailingZeros64(lineAlloc >> i)
-	if n == 64 {
-		n -= i
-	}
-	b.lineAlloc = lineAlloc | (((1 << n) - 1) << i)
-	b.cursor = uintptr(unsafe.Pointer(b.data)) + uintptr(i)*lineSize
-	b.limit = b.cursor + uintptr(n)*lineSize
-	if i == 2 {
-		b.cursor += 16 // Room for LineEscape and Region.
+	n := b.lineAlloc.next(i, true) - i
+	b.refills++
+	b.lineAlloc.setRange(i, n)
+	b.cursor = uintptr(unsafe.Pointer(b.data)) + i*lineSize
+	b.limit = b.cursor + n*lineSize
+	if metaEnd := b.Base() + metaSize; b.cursor < metaEnd {
+		b.cursor = metaEnd // Skip the rest of the metadata.
 	}
 	return true
 }
 
 func (b *Block) Reset() {
-	// First two lines are reserved.
+	// The lines holding the metadata are reserved.
 	d := b.Meta()
-	b.lineAlloc = d.LineEscape | 0b11
+	b.lineAlloc = d.LineEscape.or(reservedLineMask)
 	b.cursor, b.limit = 0, 0
 
-	// Clear ObjBits.
-
-	// Make the math easier by reinterpreting ObjBits as 16-bit chunks.
-	// Only works on little-endian.
-	ObjBits := (*[BitmapSize / 2]uint16)(unsafe.Pointer(&d.ObjBits[0]))
+	// Clear ObjBits for every free line, leaving the bits for
+	// pinned lines alone.
+	var free LineMask
+	free.setAll()
+	free = free.andNot(b.lineAlloc)
+	clearLineBits(&d.ObjBits, free)
+	d.clearHeaders(free)
 
-	clearIter := b.lineAlloc
-	for clearIter != 0 {
-		i := bits.TrailingZeros64(^clearIter)
-		clearIter >>= i
-		n := bits.TrailingZeros64(clearIter)
-		if n == 64 {
-			n -= i
-		}
-		toClear := ObjBits[i : i+n]
-		for i := range toClear {
-			toClear[i] = 0
+	// Pinned lines may also contain dead objects that didn't escape.
+	// Forget about them, so that only escaped objects have start bits.
+	if !d.LineEscape.IsZero() {
+		for k := range d.ObjBits {
+			d.ObjBits[k] &= d.EscBits[k]
 		}
-		clearIter >>= n
 	}
 }
 
@@ -224,11 +329,49 @@ func (b *Block) Meta() *BlockMeta {
 	return (*BlockMeta)(unsafe.Pointer(&b.data[0]))
 }
 
+// blockMeta returns the metadata of the regular block containing p.
+func blockMeta(p unsafe.Pointer) *BlockMeta {
+	return (*BlockMeta)(unsafe.Add(p, -int(uintptr(p)&(BlockSize-1))))
+}
+
+// at returns address p, which must be in the memory of the block with
+// metadata d, as a pointer.
+func (d *BlockMeta) at(p uintptr) unsafe.Pointer {
+	return unsafe.Add(unsafe.Pointer(d), p-uintptr(unsafe.Pointer(d)))
+}
+
 type BlockMeta struct {
-	EscBits    [BitmapSize / 8]uint64
-	ObjBits    [BitmapSize / 8]uint64
-	LineEscape uint64
-	Region     uintptr
+	EscBits [BitmapSize / 8]uint64
+	ObjBits [BitmapSize / 8]uint64
+
+	// headers holds object headers for layouts that keep them out of
+	// line. It's empty otherwise. It's not the last field, so that it
+	// doesn't add padding when it's empty.
+	headers lineHeaders
+
+	LineEscape LineMask
+	Region     uint64 // Not a uintptr, to keep the layout the same on 32-bit platforms.
+}
+
+// objHeader describes an object: a pointer to its type in the low 48
+// bits, and its size in words in the high 16 bits. Where headers are
+// kept depends on the object layout; see layout_header.go and
+// layout_headerless.go.
+type objHeader uint64
+
+func makeObjHeader(typ *FakeType, size uintptr) objHeader {
+	return objHeader(uintptr(unsafe.Pointer(typ))) | objHeader(size/ptrSize)<<48
+}
+
+func (h objHeader) typ() *FakeType {
+	// The type pointer is packed in with the size, so it can only be
+	// put back together from its bits.
+	p := uintptr(h & (1<<48 - 1))
+	return *(**FakeType)(unsafe.Pointer(&p))
+}
+
+func (h objHeader) size() uintptr {
+	return uintptr(h>>48) * ptrSize
 }
 
 //go:linkname memclrNoHeapPointers runtime.memclrNoHeapPointers
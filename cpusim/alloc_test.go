@@ -6,8 +6,11 @@ package cpusim_test
 
 import (
 	"fmt"
+	"math"
 	"runtime"
+	"slices"
 	"testing"
+	"unsafe"
 
 	"github.com/aclements/go-perfevent/perfbench"
 	"github.com/mknyszek/region-eval/cpusim"
@@ -20,6 +23,36 @@ var sink any
 var alwaysFalse bool
 
 func BenchmarkAlloc(b *testing.B) {
+	benchAllocSizes(b, func() benchAllocator {
+		return regionAllocator{cpusim.NewAllocator(nil)}
+	})
+}
+
+// BenchmarkBaselineAlloc runs the same benchmarks as BenchmarkAlloc
+// against BaselineAllocator, the model of the runtime's allocator, so
+// that their results may be compared directly.
+func BenchmarkBaselineAlloc(b *testing.B) {
+	benchAllocSizes(b, func() benchAllocator {
+		return cpusim.NewBaselineAllocator()
+	})
+}
+
+// benchAllocator is what benchAlloc needs from an allocator.
+type benchAllocator interface {
+	Make(size uintptr, typ *cpusim.FakeType) cpusim.Pointer
+	Reset()
+}
+
+// regionAllocator adapts Allocator to benchAllocator.
+type regionAllocator struct {
+	*cpusim.Allocator
+}
+
+func (a regionAllocator) Reset() {
+	a.Allocator.Reset()
+}
+
+func benchAllocSizes(b *testing.B, newAlloc func() benchAllocator) {
 	for _, ptrs := range []bool{false, true} {
 		for _, reset := range []bool{false, true} {
 			b.Run(fmt.Sprintf("ptrs=%t/reset=%t", ptrs, reset), func(b *testing.B) {
@@ -30,21 +63,21 @@ func BenchmarkAlloc(b *testing.B) {
 				ballast = make([]byte, llcBytes)
 				defer func() { ballast = nil }()
 
-				benchAlloc(b, 8, ptrs, reset)
-				benchAlloc(b, 16, ptrs, reset)
-				benchAlloc(b, 32, ptrs, reset)
-				benchAlloc(b, 64, ptrs, reset)
-				benchAlloc(b, 128, ptrs, reset)
-				benchAlloc(b, 256, ptrs, reset)
-				benchAlloc(b, 512, ptrs, reset)
-				benchAlloc(b, 1024, ptrs, reset)
-				benchAlloc(b, 2048, ptrs, reset)
+				benchAlloc(b, newAlloc, 8, ptrs, reset)
+				benchAlloc(b, newAlloc, 16, ptrs, reset)
+				benchAlloc(b, newAlloc, 32, ptrs, reset)
+				benchAlloc(b, newAlloc, 64, ptrs, reset)
+				benchAlloc(b, newAlloc, 128, ptrs, reset)
+				benchAlloc(b, newAlloc, 256, ptrs, reset)
+				benchAlloc(b, newAlloc, 512, ptrs, reset)
+				benchAlloc(b, newAlloc, 1024, ptrs, reset)
+				benchAlloc(b, newAlloc, 2048, ptrs, reset)
 			})
 		}
 	}
 }
 
-func benchAlloc(b *testing.B, size uintptr, ptrs, benchReset bool) {
+func benchAlloc(b *testing.B, newAlloc func() benchAllocator, size uintptr, ptrs, benchReset bool) {
 	b.Run(fmt.Sprintf("bytes=%d", size), func(b *testing.B) {
 		cs := perfbench.Open(b)
 
@@ -52,7 +85,7 @@ func benchAlloc(b *testing.B, size uintptr, ptrs, benchReset bool) {
 		runtime.ReadMemStats(&mstats)
 		startGCs := mstats.NumGC
 
-		a := cpusim.NewAllocator(nil)
+		a := newAlloc()
 		ppct := 0
 		if ptrs {
 			ppct = 100
@@ -68,7 +101,7 @@ func benchAlloc(b *testing.B, size uintptr, ptrs, benchReset bool) {
 			if alwaysFalse {
 				sink = x
 			}
-			total += 8 + size
+			total += cpusim.HeaderSize + size
 			if total > uintptr(len(ballast)/2) {
 				if benchReset {
 					// Reset the allocator as part of the benchmark.
@@ -94,6 +127,9 @@ func benchAlloc(b *testing.B, size uintptr, ptrs, benchReset bool) {
 		b.StopTimer()
 
 		reportPerByte(b, size, cs)
+		if ra, ok := a.(regionAllocator); ok {
+			reportAllocStats(b, ra.Stats())
+		}
 
 		// Confirm that no automatic GCs happened during the benchmark.
 		runtime.ReadMemStats(&mstats)
@@ -104,14 +140,627 @@ func benchAlloc(b *testing.B, size uintptr, ptrs, benchReset bool) {
 	})
 }
 
+// BenchmarkLayout allocates mixes of the small objects that dominate real
+// profiles, and reports how much memory they take up along with the time
+// it takes. Run it with and without -tags cpusim_headerless and compare
+// the results with benchstat to see the space and time cost of object
+// headers.
+//
+// block-bytes/obj is the bottom line. It includes meta-bytes/obj, the
+// block metadata per object, which the headerless layout grows to hold
+// its per-line headers, eating into what it saves per object.
+func BenchmarkLayout(b *testing.B) {
+	ptr := cpusim.FakePointer()
+	scalar := cpusim.FakeScalar(8)
+	pair := cpusim.FakeStruct(ptr, scalar)
+	for _, mix := range []struct {
+		name  string
+		types []*cpusim.FakeType
+	}{
+		{"8", []*cpusim.FakeType{ptr}},
+		{"16", []*cpusim.FakeType{pair}},
+		{"8+16", []*cpusim.FakeType{ptr, pair}},
+		// Different types of the same size can't share lines without
+		// headers.
+		{"8+8", []*cpusim.FakeType{ptr, scalar}},
+		{"mixed", []*cpusim.FakeType{ptr, ptr, scalar, pair, pair, cpusim.FakeScalar(16), cpusim.FakeArray(ptr, 3), cpusim.FakeStruct(pair, pair), cpusim.FakeScalar(64)}},
+	} {
+		b.Run(mix.name, func(b *testing.B) {
+			benchLayout(b, mix.types)
+		})
+	}
+}
+
+func benchLayout(b *testing.B, types []*cpusim.FakeType) {
+	// Objects allocated in each region, before a Reset.
+	const regionObjs = 1 << 14
+
+	a := cpusim.NewAllocator(nil)
+	var objects, lineBytes, blockBytes, metaBytes uint64
+	for i := range b.N {
+		typ := types[i%len(types)]
+		x := a.Make(typ.Size_, typ)
+		if alwaysFalse {
+			sink = x
+		}
+		if (i+1)%regionObjs != 0 && i != b.N-1 {
+			continue
+		}
+		b.StopTimer()
+		s := a.Stats()
+		objects += uint64(s.Objects)
+		lineBytes += uint64(s.LinesUsed) * cpusim.LineSize
+		blockBytes += uint64(s.Blocks-s.FreeBlocks) * cpusim.BlockSize
+		metaBytes += uint64(s.Blocks-s.FreeBlocks) * uint64(cpusim.MetaSize)
+		b.StartTimer()
+		a.Reset()
+	}
+	b.ReportMetric(float64(lineBytes)/float64(objects), "line-bytes/obj")
+	b.ReportMetric(float64(blockBytes)/float64(objects), "block-bytes/obj")
+	b.ReportMetric(float64(metaBytes)/float64(objects), "meta-bytes/obj")
+}
+
+func reportAllocStats(b *testing.B, s cpusim.Stats) {
+	b.ReportMetric(float64(s.Refills)/float64(b.N), "refills/op")
+	b.ReportMetric(float64(s.OverflowAllocs)/float64(b.N), "overflow-allocs/op")
+}
+
 func reportPerByte(b *testing.B, bytesPerOp uintptr, cs *perfbench.Counters) {
 	bytes := bytesPerOp * uintptr(b.N)
 	duration := b.Elapsed()
 	b.ReportMetric(float64(duration.Nanoseconds())/float64(bytes), "ns/byte")
-	if cycles, ok := cs.Total("cpu-cycles"); ok {
+	// Counters that never got to run read as +Inf, like perfbench's
+	// own per-op metrics, which it drops.
+	if cycles, ok := cs.Total("cpu-cycles"); ok && !math.IsInf(cycles, 0) {
 		b.ReportMetric(cycles/float64(bytes), "cpu-cycles/byte")
 	}
-	if inst, ok := cs.Total("instructions"); ok {
+	if inst, ok := cs.Total("instructions"); ok && !math.IsInf(inst, 0) {
 		b.ReportMetric(inst/float64(bytes), "instructions/byte")
 	}
 }
+
+func TestMakeLarge(t *testing.T) {
+	// The smallest size that doesn't fit in a regular block.
+	const minLarge = cpusim.MaxSmallSize - cpusim.HeaderSize + 8
+	for _, size := range []uintptr{minLarge, minLarge + 8, cpusim.BlockSize, cpusim.BlockSize + 8, 8 * cpusim.BlockSize, 1 << 20} {
+		for _, ptrs := range []bool{false, true} {
+			t.Run(fmt.Sprintf("size=%d/ptrs=%t", size, ptrs), func(t *testing.T) {
+				testMakeLarge(t, size, ptrs)
+			})
+		}
+	}
+}
+
+func testMakeLarge(t *testing.T, size uintptr, ptrs bool) {
+	a := cpusim.NewAllocator(nil)
+	ppct := 0
+	if ptrs {
+		ppct = 100
+	}
+	ft := makeFakeType(size, ppct)
+
+	// Mix in some small objects to make sure they don't get confused
+	// with the large ones.
+	small := a.Make(64, makeFakeType(64, 0))
+	x := a.Make(size, ft)
+	y := a.Make(size, ft)
+	if a.BlockOf(small) == a.BlockOf(x) {
+		t.Fatal("small and large object share a block")
+	}
+	if a.BlockOf(x) == a.BlockOf(y) {
+		t.Fatal("large objects share a block")
+	}
+
+	// The whole object must be inside its block and zeroed.
+	b := a.BlockOf(x)
+	if b == nil {
+		t.Fatal("no block for large object")
+	}
+	for _, off := range []uintptr{0, size / 2, size - 1} {
+		p := cpusim.Pointer(uintptr(x) + off)
+		if a.BlockOf(p) != b {
+			t.Fatalf("BlockOf(x+%d) is not the object's block", off)
+		}
+	}
+	for i := range size {
+		if *(*byte)(unsafe.Add(unsafe.Pointer(x), i)) != 0 {
+			t.Fatalf("byte %d of large object not zeroed", i)
+		}
+	}
+	if uintptr(x)%8 != 0 {
+		t.Fatalf("large object %p not 8-byte aligned", x)
+	}
+
+	// Mark escaped via an interior pointer, which may be in a later chunk.
+	cpusim.MarkEscaped(cpusim.Pointer(uintptr(x) + size - 1))
+	d := b.Meta()
+	for i := range uintptr(len(b.Lines())) {
+		if !d.LineEscape.IsSet(i) {
+			t.Fatalf("large object block not fully escaped: %064b", d.LineEscape)
+		}
+	}
+	ws := (uintptr(x) - cpusim.HeaderSize - b.Base()) / 8
+	for i := ws; i < uintptr(len(d.EscBits)*64); i++ {
+		if !isSet(&d.EscBits, i) {
+			t.Fatalf("found escape bit %d not to be set", i)
+		}
+	}
+	if yd := a.BlockOf(y).Meta(); !yd.LineEscape.IsZero() {
+		t.Fatal("unrelated large object marked escaped")
+	}
+	if sb := a.BlockOf(small); !sb.Meta().LineEscape.IsZero() {
+		t.Fatal("unrelated small object marked escaped")
+	}
+
+	// Reset keeps only the escaped large object.
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	a.Reset()
+	if a.BlockOf(x) != b {
+		t.Fatal("escaped large object dropped by Reset")
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if a.BlockOf(y) != nil {
+		t.Fatal("non-escaped large object survived Reset")
+	}
+	a.Reset()
+	if a.BlockOf(x) != b {
+		t.Fatal("escaped large object dropped by second Reset")
+	}
+}
+
+func TestMakeAligned(t *testing.T) {
+	for _, align := range []uintptr{16, 64, 128} {
+		for _, size := range []uintptr{8, 40, 248, 1000, cpusim.MaxSmallSize, 3 * cpusim.BlockSize} {
+			t.Run(fmt.Sprintf("align=%d/size=%d", align, size), func(t *testing.T) {
+				testMakeAligned(t, align, size)
+			})
+		}
+	}
+}
+
+func testMakeAligned(t *testing.T, align, size uintptr) {
+	a := cpusim.NewAllocator(nil)
+	typ := cpusim.FakeAligned(cpusim.FakeArray(cpusim.FakePointer(), size/cpusim.PtrSize), align)
+	small := cpusim.FakeScalar(8)
+
+	// Interleave small objects, so the aligned ones usually need padding,
+	// and fill the small ones to catch any overlap.
+	var objs, smalls []cpusim.Pointer
+	for range 20 {
+		s := a.Make(8, small)
+		*(*uint64)(s) = ^uint64(0)
+		smalls = append(smalls, s)
+
+		x := a.Make(typ.Size_, typ)
+		if uintptr(x)%align != 0 {
+			t.Fatalf("object %p not %d-byte aligned", x, align)
+		}
+		objs = append(objs, x)
+	}
+	for _, s := range smalls {
+		if *(*uint64)(s) != ^uint64(0) {
+			t.Fatalf("small object %p overwritten", s)
+		}
+	}
+
+	// Escaping an aligned object via an interior pointer must find its
+	// header despite the padding, and follow its pointers.
+	x, y := objs[len(objs)/2], objs[len(objs)/2+1]
+	cpusim.WritePointer(unsafe.Pointer(x), unsafe.Pointer(smalls[0]))
+	cpusim.MarkEscaped(cpusim.Pointer(uintptr(x) + typ.Size_ - 1))
+	if !cpusim.IsEscaped(x) {
+		t.Fatal("aligned object not escaped")
+	}
+	if !cpusim.IsEscaped(smalls[0]) {
+		t.Fatal("object pointed to by aligned object not escaped")
+	}
+	if cpusim.IsEscaped(y) || cpusim.IsEscaped(smalls[len(objs)/2]) {
+		t.Fatal("neighbor of aligned object escaped")
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	for _, evacuated := range []bool{false, true} {
+		t.Run(fmt.Sprintf("evacuated=%t", evacuated), func(t *testing.T) {
+			testReset(t, evacuated)
+		})
+	}
+}
+
+func testReset(t *testing.T, evacuated bool) {
+	const (
+		size  = cpusim.LineSize - 8 // Crosses line boundaries, but never needs an overflow block.
+		count = 1000
+	)
+	a := cpusim.NewAllocator(nil)
+	ft := makeFakeType(size, 0)
+
+	// Allocate enough to fill several blocks, escaping every 10th object.
+	blocks := make(map[*cpusim.Block]bool)
+	var escaped []cpusim.Pointer
+	for i := range count {
+		x := a.Make(size, ft)
+		blocks[a.BlockOf(x)] = true
+		if i%10 == 0 {
+			cpusim.MarkEscaped(x)
+			for j := range uintptr(size) {
+				*(*byte)(unsafe.Add(unsafe.Pointer(x), j)) = 0xff
+			}
+			escaped = append(escaped, x)
+		}
+	}
+
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	var stats cpusim.ResetStats
+	if evacuated {
+		stats = a.ResetEvacuated()
+	} else {
+		stats = a.Reset()
+	}
+	if stats.BlocksRecycled != len(blocks) {
+		t.Errorf("recycled %d blocks, want %d", stats.BlocksRecycled, len(blocks))
+	}
+	if evacuated && stats.LinesPinned != 0 {
+		t.Errorf("%d lines pinned after evacuation", stats.LinesPinned)
+	}
+	if !evacuated && stats.LinesPinned == 0 {
+		t.Error("no lines pinned by escaped objects")
+	}
+
+	// Allocate half as much again, which must fit in the free lines
+	// of the recycled blocks even with pinned lines. None of it may
+	// overlap with escaped objects unless they were evacuated.
+	for range count / 2 {
+		x := a.Make(size, ft)
+		if !blocks[a.BlockOf(x)] {
+			t.Fatal("allocated a new block while free lines remained")
+		}
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if evacuated {
+		return
+	}
+	for _, x := range escaped {
+		for j := range uintptr(size) {
+			if *(*byte)(unsafe.Add(unsafe.Pointer(x), j)) != 0xff {
+				t.Fatalf("escaped object %p overwritten after reset", x)
+			}
+		}
+	}
+}
+
+func TestResetRecyclesEverything(t *testing.T) {
+	a := cpusim.NewAllocator(nil)
+	small := makeFakeType(cpusim.LineSize/2-cpusim.HeaderSize, 0)
+	medium := makeFakeType(3*cpusim.LineSize, 0)
+
+	// Pin a line every few lines. Every sixth small object escapes, and
+	// the one after it dies, usually in the same line.
+	blocks := make(map[*cpusim.Block]bool)
+	var escaped []cpusim.Pointer
+	dead := make(map[cpusim.Pointer]*cpusim.Block)
+	for i := range 2000 {
+		x := a.Make(small.Size_, small)
+		blocks[a.BlockOf(x)] = true
+		switch i % 6 {
+		case 0:
+			cpusim.MarkEscaped(x)
+			escaped = append(escaped, x)
+		case 1:
+			dead[x] = a.BlockOf(x)
+		}
+	}
+	a.Reset()
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dead objects sharing a pinned line with an escaped one are
+	// forgotten.
+	for x, b := range dead {
+		for obj := range b.Objects() {
+			if obj.Addr == x {
+				t.Fatalf("dead object %p still has a start bit after reset", x)
+			}
+		}
+	}
+	if s := a.Stats(); s.Objects != len(escaped) {
+		t.Errorf("got %d objects after reset, want %d", s.Objects, len(escaped))
+	}
+
+	// Medium objects don't fit between the pinned lines, so they keep
+	// spilling into overflow blocks and replacing them. Every block,
+	// including replaced overflow blocks, is recycled.
+	used := make(map[*cpusim.Block]bool)
+	for range 2000 {
+		x := a.Make(medium.Size_, medium)
+		used[a.BlockOf(x)] = true
+		blocks[a.BlockOf(x)] = true
+	}
+	if s := a.Stats(); s.OverflowBlocks < 2 {
+		t.Fatalf("got %d overflow blocks, want at least 2", s.OverflowBlocks)
+	}
+	if stats := a.Reset(); stats.BlocksRecycled < len(used) {
+		t.Errorf("recycled %d blocks, want at least %d", stats.BlocksRecycled, len(used))
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Evacuating unpins lines in blocks that were already free.
+	a.ResetEvacuated()
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if s := a.Stats(); s.LinesEscaped != 0 || s.Objects != 0 {
+		t.Errorf("got %d escaped lines and %d objects after evacuation, want none", s.LinesEscaped, s.Objects)
+	}
+	for b := range blocks {
+		for i, l := range b.Lines() {
+			if l == cpusim.LineEscaped {
+				t.Fatalf("line %d of free block %p still pinned after evacuation", i, b)
+			}
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	a := cpusim.NewAllocator(nil)
+	small := makeFakeType(56, 0)
+	medium := makeFakeType(1016, 0)
+
+	const n = 200
+	var escaped []cpusim.Pointer
+	for i := range n {
+		x := a.Make(56, small)
+		if i%50 == 0 {
+			cpusim.MarkEscaped(x)
+			escaped = append(escaped, x)
+		}
+		a.Make(1016, medium)
+	}
+	a.Make(64<<10, makeFakeType(64<<10, 0))
+
+	s := a.Stats()
+	if s.Objects != 2*n+1 {
+		t.Errorf("got %d objects, want %d", s.Objects, 2*n+1)
+	}
+	// Every object has a header in the default layout, but only some of
+	// them do in the headerless one.
+	if lo, hi := uint64(n*(56+1016+2*cpusim.HeaderSize)), uint64(n*(56+1016+2*8)); s.ObjectBytes < lo || s.ObjectBytes > hi {
+		t.Errorf("got %d object bytes, want between %d and %d", s.ObjectBytes, lo, hi)
+	}
+	if want := uint64(cpusim.HeaderSize + 64<<10); s.LargeObjectBytes != want {
+		t.Errorf("got %d large object bytes, want %d", s.LargeObjectBytes, want)
+	}
+	if s.EscapedObjects != len(escaped) {
+		t.Errorf("got %d escaped objects, want %d", s.EscapedObjects, len(escaped))
+	}
+	if s.LargeBlocks != 1 || s.LargeAllocs != 1 {
+		t.Errorf("got %d large blocks and %d large allocs, want 1 and 1", s.LargeBlocks, s.LargeAllocs)
+	}
+	if s.Refills == 0 {
+		t.Error("no refills recorded")
+	}
+	if s.LinesEscaped == 0 || s.LinesEscaped > 2*len(escaped) {
+		t.Errorf("got %d escaped lines for %d small escaped objects", s.LinesEscaped, len(escaped))
+	}
+	if u := s.Utilization(); u <= 0.5 || u > 1 {
+		t.Errorf("utilization %f out of range", u)
+	}
+
+	// Cross-check against the per-block view.
+	var lines, objs int
+	for _, x := range escaped {
+		b := a.BlockOf(x)
+		found := false
+		for obj := range b.EscapedObjects() {
+			if obj.Addr == x {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("escaped object %p not found in its block", x)
+		}
+	}
+	seen := make(map[*cpusim.Block]bool)
+	for _, x := range escaped {
+		b := a.BlockOf(x)
+		if seen[b] {
+			continue
+		}
+		seen[b] = true
+		for _, l := range b.Lines() {
+			if l == cpusim.LineEscaped {
+				lines++
+			}
+		}
+		for range b.EscapedObjects() {
+			objs++
+		}
+	}
+	if lines != s.LinesEscaped || objs != s.EscapedObjects {
+		t.Errorf("per-block view found %d escaped lines and %d escaped objects, want %d and %d", lines, objs, s.LinesEscaped, s.EscapedObjects)
+	}
+
+	// After a reset, only escaped objects remain.
+	a.Reset()
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	s = a.Stats()
+	if s.Objects != len(escaped) || s.EscapedObjects != len(escaped) {
+		t.Errorf("got %d objects (%d escaped) after reset, want %d", s.Objects, s.EscapedObjects, len(escaped))
+	}
+	if s.FreeBlocks != s.Blocks {
+		t.Errorf("got %d free blocks after reset, want %d", s.FreeBlocks, s.Blocks)
+	}
+}
+
+// fuzzObj is the model of an object allocated by FuzzAllocator.
+type fuzzObj struct {
+	x       cpusim.Pointer
+	size    uintptr
+	ptrs    []*fuzzObj // Nil if the object has no pointers.
+	escaped bool
+}
+
+// escape marks o and everything reachable from it escaped.
+func (o *fuzzObj) escape() {
+	if o.escaped {
+		return
+	}
+	o.escaped = true
+	for _, p := range o.ptrs {
+		if p != nil {
+			p.escape()
+		}
+	}
+}
+
+// fuzzScalar is shared by all runs of fuzzAllocator, since FakeTypes are
+// never freed.
+var fuzzScalar = cpusim.FakeScalar(8)
+
+func FuzzAllocator(f *testing.F) {
+	f.Add([]byte{0, 1, 0x81, 0, 2, 0x81, 3, 0, 0, 1, 2, 0, 4, 0, 5, 0})
+	f.Add([]byte{1, 0x10, 0x80, 0, 0x20, 0x81, 3, 1, 2, 0, 2, 1, 4, 1, 0x7f, 0x80, 5})
+	f.Add([]byte{0, 0xff, 0xff, 0, 0xff, 0xff, 0, 0xff, 0xff, 3, 0, 9, 1, 2, 0, 4, 0, 0xff, 0xff, 4})
+	f.Fuzz(fuzzAllocator)
+}
+
+// fuzzAllocator interprets ops as a sequence of Make, MarkEscaped,
+// WritePointer, Reset and ResetEvacuated calls, and checks the allocator
+// against a simple model of which objects are live and escaped.
+func fuzzAllocator(t *testing.T, ops []byte) {
+	if len(ops) > 1024 {
+		ops = ops[:1024]
+	}
+	next := func() int {
+		if len(ops) == 0 {
+			return 0
+		}
+		b := ops[0]
+		ops = ops[1:]
+		return int(b)
+	}
+
+	a := cpusim.NewAllocator(nil)
+	var objs []*fuzzObj
+
+	// check checks the allocator against the model. It's expensive, so
+	// it only runs around resets and at the end.
+	check := func() {
+		if err := a.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range objs {
+			if got := cpusim.IsEscaped(o.x); got != o.escaped {
+				t.Fatalf("object %p: escaped = %v, want %v", o.x, got, o.escaped)
+			}
+			for i, p := range o.ptrs {
+				var want unsafe.Pointer
+				if p != nil {
+					want = unsafe.Pointer(p.x)
+				}
+				if got := *(*unsafe.Pointer)(unsafe.Add(unsafe.Pointer(o.x), i*8)); got != want {
+					t.Fatalf("object %p: word %d is %p, want %p", o.x, i, got, want)
+				}
+			}
+		}
+		if s := a.Stats(); s.Objects != len(objs) {
+			t.Fatalf("allocator has %d objects, want %d", s.Objects, len(objs))
+		}
+	}
+	for len(ops) > 0 {
+		switch op := next() % 6; op {
+		case 0, 1:
+			// Make. Op 1 makes objects large enough to need overflow
+			// blocks or be large objects.
+			n := uintptr(next()) | uintptr(next())<<8
+			ptrs := n&0x8000 != 0
+			if op == 0 {
+				n = 1 + n%64
+			} else {
+				n = 1 + n%3000
+			}
+			typ := fuzzScalar
+			if ptrs {
+				typ = cpusim.FakePointer()
+			}
+			o := &fuzzObj{x: a.Make(n*8, typ), size: n * 8}
+			if ptrs {
+				o.ptrs = make([]*fuzzObj, n)
+			}
+			mem := unsafe.Slice((*byte)(o.x), o.size)
+			for i, b := range mem {
+				if b != 0 {
+					t.Fatalf("new object %p of %d bytes has nonzero byte at offset %d", o.x, o.size, i)
+				}
+			}
+			for _, p := range objs {
+				if uintptr(o.x) < uintptr(p.x)+p.size && uintptr(p.x) < uintptr(o.x)+o.size {
+					t.Fatalf("new object [%p, +%d) overlaps live object [%p, +%d)", o.x, o.size, p.x, p.size)
+				}
+			}
+			objs = append(objs, o)
+		case 2:
+			// MarkEscaped.
+			if len(objs) == 0 {
+				continue
+			}
+			o := objs[next()%len(objs)]
+			cpusim.MarkEscaped(o.x)
+			o.escape()
+		case 3:
+			// WritePointer.
+			if len(objs) == 0 {
+				continue
+			}
+			src := objs[next()%len(objs)]
+			i := next()
+			var dst *fuzzObj
+			if j := next(); j < 4*len(objs) {
+				// Leave some chance of a nil write.
+				dst = objs[j%len(objs)]
+			}
+			if src.ptrs == nil {
+				continue
+			}
+			i %= len(src.ptrs)
+			var ptr unsafe.Pointer
+			if dst != nil {
+				ptr = unsafe.Pointer(dst.x)
+			}
+			cpusim.WritePointer(unsafe.Add(unsafe.Pointer(src.x), i*8), ptr)
+			src.ptrs[i] = dst
+			if src.escaped && dst != nil {
+				dst.escape()
+			}
+		case 4:
+			// Reset. Only escaped objects survive.
+			check()
+			a.Reset()
+			objs = slices.DeleteFunc(objs, func(o *fuzzObj) bool { return !o.escaped })
+			check()
+		case 5:
+			// ResetEvacuated. Nothing survives.
+			check()
+			a.ResetEvacuated()
+			objs = objs[:0]
+			check()
+		}
+	}
+	check()
+}
@@ -0,0 +1,533 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import (
+	"math/bits"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// BaselineAllocator is a simplified model of the runtime's allocator,
+// mallocgc, for comparing the cost of allocating from a region against
+// the cost of allocating from the heap on the same machine, in the same
+// run.
+//
+// Like the runtime, it rounds small objects up to a size class and
+// allocates them from spans of pages dedicated to that class, one cached
+// span per class and scan/noscan kind, like an mcache. Spans find free
+// slots with freeindex and allocCache, exactly like the runtime's. Small
+// noscan objects are combined by a tiny allocator. Objects with pointers
+// have them recorded the same way the runtime does: in a bitmap at the
+// end of the span for objects up to minSizeForMallocHeader bytes, in a
+// header holding the type for bigger small objects, and in the span
+// for large objects, which get a span of their own.
+//
+// It leaves out everything that isn't on the allocation path itself:
+// there are no GC assists, no profiling and no central free lists shared
+// between threads. Garbage collection is up to a Collector. Reset stands
+// in for a GC cycle that finds every object dead.
+type BaselineAllocator struct {
+	// alloc is the span each span class is currently allocating from,
+	// like mcache.alloc.
+	alloc [numSpanClasses]*baseSpan
+
+	// partial has the swept spans of each span class with free
+	// objects, like mcentral's partial swept set.
+	partial [numSpanClasses][]*baseSpan
+
+	// allspans has every span, and spans maps the address of each of
+	// their pages to them, like the runtime's span lookup.
+	allspans []*baseSpan
+	spans    map[uintptr]*baseSpan
+
+	// The tiny allocator's current block, and the offset of the next
+	// free byte in it.
+	tiny       unsafe.Pointer
+	tinyoffset uintptr
+}
+
+// zerobase is the address of all zero-sized objects, like the runtime's.
+var zerobase uintptr
+
+func NewBaselineAllocator() *BaselineAllocator {
+	return &BaselineAllocator{spans: make(map[uintptr]*baseSpan)}
+}
+
+// Runtime allocator constants, from internal/runtime/gc and runtime.
+const (
+	pageSize               = 8192
+	maxSmallSizeBaseline   = 32768
+	smallSizeDiv           = 8
+	smallSizeMax           = 1024
+	largeSizeDiv           = 128
+	numSizeClasses         = 68
+	numSpanClasses         = numSizeClasses << 1
+	maxTinySize            = 16
+	tinySpanClass          = spanClass(2<<1 | 1)
+	minSizeForMallocHeader = ptrSize * ptrBits
+	mallocHeaderSize       = 8
+)
+
+var classToSize = [numSizeClasses]uint16{0, 8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208, 224, 240, 256, 288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704, 768, 896, 1024, 1152, 1280, 1408, 1536, 1792, 2048, 2304, 2688, 3072, 3200, 3456, 4096, 4864, 5376, 6144, 6528, 6784, 6912, 8192, 9472, 9728, 10240, 10880, 12288, 13568, 14336, 16384, 18432, 19072, 20480, 21760, 24576, 27264, 28672, 32768}
+var classToNPages = [numSizeClasses]uint8{0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2, 1, 2, 1, 2, 1, 3, 2, 3, 1, 3, 2, 3, 4, 5, 6, 1, 7, 6, 5, 4, 3, 5, 7, 2, 9, 7, 5, 8, 3, 10, 7, 4}
+
+// sizeToClass8 and sizeToClass128 map sizes to size classes, like the
+// runtime's tables of the same names. They're built by init from
+// classToSize.
+var (
+	sizeToClass8   [smallSizeMax/smallSizeDiv + 1]uint8
+	sizeToClass128 [(maxSmallSizeBaseline-smallSizeMax)/largeSizeDiv + 1]uint8
+)
+
+func init() {
+	c := uint8(0)
+	for i := range sizeToClass8 {
+		for uintptr(classToSize[c]) < uintptr(i)*smallSizeDiv {
+			c++
+		}
+		sizeToClass8[i] = c
+	}
+	for i := range sizeToClass128 {
+		for uintptr(classToSize[c]) < smallSizeMax+uintptr(i)*largeSizeDiv {
+			c++
+		}
+		sizeToClass128[i] = c
+	}
+}
+
+// spanClass is a size class and whether its objects have pointers, in
+// the low bit, like the runtime's.
+type spanClass uint8
+
+func makeSpanClass(sizeclass uint8, noscan bool) spanClass {
+	sc := spanClass(sizeclass << 1)
+	if noscan {
+		sc |= 1
+	}
+	return sc
+}
+
+func (sc spanClass) sizeclass() uint8 {
+	return uint8(sc >> 1)
+}
+
+func (sc spanClass) noscan() bool {
+	return sc&1 != 0
+}
+
+// baseSpan is a run of pages holding objects of one span class, or one
+// large object, like the runtime's mspan.
+type baseSpan struct {
+	data       []byte
+	elemsize   uintptr
+	nelems     uintptr
+	freeindex  uintptr
+	allocCount uintptr
+	allocCache uint64
+	allocBits  []uint8
+	gcmarkBits []uint8
+	spanclass  spanClass
+	needzero   bool
+
+	// largeType is the type of a large object with pointers.
+	largeType *FakeType
+}
+
+func (s *baseSpan) base() uintptr {
+	return uintptr(unsafe.Pointer(&s.data[0]))
+}
+
+// at returns a pointer to offset off in s.
+func (s *baseSpan) at(off uintptr) unsafe.Pointer {
+	return unsafe.Add(unsafe.Pointer(&s.data[0]), off)
+}
+
+// heapBitsInSpan returns whether the pointers of objects of the given
+// size are recorded in a bitmap at the end of their span.
+func heapBitsInSpan(size uintptr) bool {
+	return size <= minSizeForMallocHeader
+}
+
+// heapBits returns the span's pointer bitmap, which has a bit for every
+// word of the span.
+func (s *baseSpan) heapBits() []uintptr {
+	const n = pageSize / ptrSize / ptrBits
+	return unsafe.Slice((*uintptr)(unsafe.Pointer(&s.data[pageSize-n*ptrSize])), n)
+}
+
+// Make allocates a zeroed object of the given size and type.
+//
+// If typ has pointers, size must be a multiple of its size, since the
+// object is treated as an array of typ, like in the runtime. Make panics
+// otherwise.
+func (a *BaselineAllocator) Make(size uintptr, typ *FakeType) Pointer {
+	if size == 0 {
+		return Pointer(unsafe.Pointer(&zerobase))
+	}
+	noscan := typ.PtrBytes == 0
+	if !noscan && size%typ.Size_ != 0 {
+		panic("size must be a multiple of the type's size")
+	}
+	var x unsafe.Pointer
+	if size <= maxSmallSizeBaseline-mallocHeaderSize {
+		if noscan && size < maxTinySize {
+			x = a.mallocTiny(size)
+		} else if noscan {
+			x, _ = a.mallocSmall(size, true)
+		} else if heapBitsInSpan(size) {
+			var s *baseSpan
+			x, s = a.mallocSmall(size, false)
+			s.writeHeapBitsSmall(x, size, typ)
+		} else {
+			x, _ = a.mallocSmall(size+mallocHeaderSize, false)
+			*(**FakeType)(x) = typ
+			x = unsafe.Add(x, mallocHeaderSize)
+		}
+	} else {
+		x = a.mallocLarge(size, typ)
+	}
+	return Pointer(x)
+}
+
+// mallocTiny allocates a small noscan object by combining it with others
+// in a maxTinySize block, like the runtime's tiny allocator.
+func (a *BaselineAllocator) mallocTiny(size uintptr) unsafe.Pointer {
+	off := a.tinyoffset
+	// Align tiny pointer for required (conservative) alignment.
+	if size&7 == 0 {
+		off = bitmath.AlignUp(off, 8)
+	} else if ptrSize == 4 && size == 12 {
+		off = bitmath.AlignUp(off, 8)
+	} else if size&3 == 0 {
+		off = bitmath.AlignUp(off, 4)
+	} else if size&1 == 0 {
+		off = bitmath.AlignUp(off, 2)
+	}
+	if off+size <= maxTinySize && a.tiny != nil {
+		x := unsafe.Add(a.tiny, off)
+		a.tinyoffset = off + size
+		return x
+	}
+	// Allocate a new maxTinySize block.
+	s := a.alloc[tinySpanClass]
+	v := nextFreeFast(s)
+	if v == 0 {
+		v = a.nextFree(tinySpanClass)
+		s = a.alloc[tinySpanClass]
+	}
+	x := s.at(v - s.base())
+	(*[2]uint64)(x)[0] = 0
+	(*[2]uint64)(x)[1] = 0
+	// See if we need to replace the existing tiny block with the new
+	// one based on amount of remaining free space.
+	if size < a.tinyoffset || a.tiny == nil {
+		a.tiny = x
+		a.tinyoffset = size
+	}
+	return x
+}
+
+// mallocSmall allocates a zeroed object from a span of size's class, and
+// returns it along with the span.
+func (a *BaselineAllocator) mallocSmall(size uintptr, noscan bool) (unsafe.Pointer, *baseSpan) {
+	spc := makeSpanClass(sizeToClass(size), noscan)
+	s := a.alloc[spc]
+	v := nextFreeFast(s)
+	if v == 0 {
+		v = a.nextFree(spc)
+		s = a.alloc[spc]
+	}
+	x := s.at(v - s.base())
+	if s.needzero {
+		memclrNoHeapPointers(x, s.elemsize)
+	}
+	return x, s
+}
+
+// mallocLarge allocates an object in a span of its own.
+func (a *BaselineAllocator) mallocLarge(size uintptr, typ *FakeType) unsafe.Pointer {
+	npages := bitmath.AlignUp(size, pageSize) / pageSize
+	s := &baseSpan{
+		data:       allocPages(npages),
+		elemsize:   npages * pageSize,
+		nelems:     1,
+		freeindex:  1,
+		allocCount: 1,
+		allocBits:  make([]uint8, 8),
+		gcmarkBits: make([]uint8, 8),
+	}
+	if typ.PtrBytes != 0 {
+		s.largeType = typ
+	}
+	a.addSpan(s)
+	return s.at(0)
+}
+
+func sizeToClass(size uintptr) uint8 {
+	if size <= smallSizeMax-8 {
+		return sizeToClass8[(size+smallSizeDiv-1)/smallSizeDiv]
+	}
+	return sizeToClass128[(size-smallSizeMax+largeSizeDiv-1)/largeSizeDiv]
+}
+
+// nextFreeFast returns the next free object in s, if one is quickly
+// available. Otherwise it returns 0.
+func nextFreeFast(s *baseSpan) uintptr {
+	if s == nil {
+		return 0
+	}
+	theBit := uintptr(bits.TrailingZeros64(s.allocCache)) // Is there a free object in the allocCache?
+	if theBit < 64 {
+		result := s.freeindex + theBit
+		if result < s.nelems {
+			freeidx := result + 1
+			if freeidx%64 == 0 && freeidx != s.nelems {
+				return 0
+			}
+			s.allocCache >>= theBit + 1
+			s.freeindex = freeidx
+			s.allocCount++
+			return result*s.elemsize + s.base()
+		}
+	}
+	return 0
+}
+
+// nextFree returns the next free object from the cached span of class
+// spc, replacing it with one that has free objects if it's full.
+func (a *BaselineAllocator) nextFree(spc spanClass) uintptr {
+	s := a.alloc[spc]
+	freeIndex := uintptr(0)
+	if s != nil {
+		freeIndex = s.nextFreeIndex()
+	}
+	if s == nil || freeIndex == s.nelems {
+		// The span is full.
+		a.refill(spc)
+		s = a.alloc[spc]
+		freeIndex = s.nextFreeIndex()
+	}
+	s.allocCount++
+	return freeIndex*s.elemsize + s.base()
+}
+
+// refill replaces the cached span of class spc with one that has free
+// objects, either a swept one or a new one.
+func (a *BaselineAllocator) refill(spc spanClass) {
+	var s *baseSpan
+	if p := a.partial[spc]; len(p) != 0 {
+		s = p[len(p)-1]
+		a.partial[spc] = p[:len(p)-1]
+	} else {
+		s = newBaseSpan(spc)
+		a.addSpan(s)
+	}
+	s.refillAllocCache(0)
+	a.alloc[spc] = s
+}
+
+// newBaseSpan returns a new span of class spc, fresh from the OS, so
+// already zeroed.
+func newBaseSpan(spc spanClass) *baseSpan {
+	npages := uintptr(classToNPages[spc.sizeclass()])
+	elemsize := uintptr(classToSize[spc.sizeclass()])
+	s := &baseSpan{
+		data:      allocPages(npages),
+		elemsize:  elemsize,
+		spanclass: spc,
+	}
+	usable := npages * pageSize
+	if !spc.noscan() && heapBitsInSpan(elemsize) {
+		usable -= uintptr(len(s.heapBits())) * ptrSize
+	}
+	s.nelems = usable / elemsize
+	// Round up so that refillAllocCache can always read 8 bytes.
+	s.allocBits = make([]uint8, bitmath.AlignUp(s.nelems, 64)/8)
+	s.gcmarkBits = make([]uint8, len(s.allocBits))
+	return s
+}
+
+// allocPages returns zeroed, page-aligned memory for npages pages.
+func allocPages(npages uintptr) []byte {
+	buf := make([]byte, npages*pageSize)
+	if addr := uintptr(unsafe.Pointer(&buf[0])); bitmath.AlignDown(addr, pageSize) != addr {
+		buf = make([]byte, (npages+1)*pageSize)
+		addr = uintptr(unsafe.Pointer(&buf[0]))
+		buf = buf[bitmath.AlignUp(addr, pageSize)-addr:][:npages*pageSize]
+	}
+	return buf
+}
+
+// addSpan adds a new span to the heap.
+func (a *BaselineAllocator) addSpan(s *baseSpan) {
+	a.allspans = append(a.allspans, s)
+	for p := uintptr(0); p < uintptr(len(s.data)); p += pageSize {
+		a.spans[s.base()+p] = s
+	}
+}
+
+// spanOf returns the span containing p, or nil if p doesn't point into
+// the heap.
+func (a *BaselineAllocator) spanOf(p uintptr) *baseSpan {
+	return a.spans[bitmath.AlignDown(p, pageSize)]
+}
+
+// nextFreeIndex returns the index of the next free object in s at or
+// after s.freeindex, or s.nelems if there are none.
+func (s *baseSpan) nextFreeIndex() uintptr {
+	sfreeindex := s.freeindex
+	snelems := s.nelems
+	if sfreeindex == snelems {
+		return sfreeindex
+	}
+
+	aCache := s.allocCache
+	bitIndex := uintptr(bits.TrailingZeros64(aCache))
+	for bitIndex == 64 {
+		// Move index to start of next cached bits.
+		sfreeindex = (sfreeindex + 64) &^ (64 - 1)
+		if sfreeindex >= snelems {
+			s.freeindex = snelems
+			return snelems
+		}
+		// Refill s.allocCache with the next 64 alloc bits.
+		s.refillAllocCache(sfreeindex / 8)
+		aCache = s.allocCache
+		bitIndex = uintptr(bits.TrailingZeros64(aCache))
+	}
+	result := sfreeindex + bitIndex
+	if result >= snelems {
+		s.freeindex = snelems
+		return snelems
+	}
+
+	s.allocCache >>= bitIndex + 1
+	sfreeindex = result + 1
+	if sfreeindex%64 == 0 && sfreeindex != snelems {
+		// All of allocCache has been used up. Refill it with the
+		// bits starting at the new freeindex.
+		s.refillAllocCache(sfreeindex / 8)
+	}
+	s.freeindex = sfreeindex
+	return result
+}
+
+// refillAllocCache loads the 64 alloc bits starting at byte whichByte of
+// allocBits into allocCache, inverted so that set bits are free objects.
+func (s *baseSpan) refillAllocCache(whichByte uintptr) {
+	bytes := (*[8]uint8)(s.allocBits[whichByte:])
+	aCache := uint64(0)
+	aCache |= uint64(bytes[0])
+	aCache |= uint64(bytes[1]) << (1 * 8)
+	aCache |= uint64(bytes[2]) << (2 * 8)
+	aCache |= uint64(bytes[3]) << (3 * 8)
+	aCache |= uint64(bytes[4]) << (4 * 8)
+	aCache |= uint64(bytes[5]) << (5 * 8)
+	aCache |= uint64(bytes[6]) << (6 * 8)
+	aCache |= uint64(bytes[7]) << (7 * 8)
+	s.allocCache = ^aCache
+}
+
+// writeHeapBitsSmall records the pointers of the object at x, which has
+// dataSize bytes of type typ, in s's heap bitmap. dataSize must be a
+// multiple of typ.Size_.
+func (s *baseSpan) writeHeapBitsSmall(x unsafe.Pointer, dataSize uintptr, typ *FakeType) {
+	// The objects here are always really small, so a single load is sufficient.
+	src0 := readUintptr(typ.GCData)
+
+	// Create repetitions of the bitmap if we have a small slice backing store.
+	src := src0
+	if typ.Size_ == ptrSize {
+		src = (1 << (dataSize / ptrSize)) - 1
+	} else {
+		for i := typ.Size_; i < dataSize; i += typ.Size_ {
+			src |= src0 << (i / ptrSize)
+		}
+	}
+
+	// Since we're never writing more than one uintptr's worth of bits,
+	// we're either going to do one or two writes.
+	dst := s.heapBits()
+	o := (uintptr(x) - s.base()) / ptrSize
+	i := o / ptrBits
+	j := o % ptrBits
+	bits := s.elemsize / ptrSize
+	if j+bits > ptrBits {
+		// Two writes.
+		bits0 := ptrBits - j
+		bits1 := bits - bits0
+		dst[i] = dst[i]&(^uintptr(0)>>bits0) | (src << j)
+		dst[i+1] = dst[i+1]&^((1<<bits1)-1) | (src >> bits0)
+	} else {
+		// One write.
+		dst[i] = dst[i]&^(((1<<bits)-1)<<j) | (src << j)
+	}
+}
+
+// Reset frees every object, as if a GC cycle had found them all dead.
+// Small object spans are kept for reuse, and must be zeroed as they're
+// allocated from again. Large object spans are released.
+func (a *BaselineAllocator) Reset() {
+	for _, s := range a.allspans {
+		clear(s.gcmarkBits)
+	}
+	a.sweep()
+}
+
+// sweep frees every object that isn't marked in its span's gcmarkBits,
+// like sweeping at the end of a GC cycle, and returns the number of
+// objects and bytes freed. Spans with free objects are put back on the
+// partial lists, and spans with no objects left in them are kept for
+// reuse, except for large object spans, which are released.
+func (a *BaselineAllocator) sweep() (objects, bytes uint64) {
+	// Like the runtime, flush the cached spans and the tiny block first.
+	clear(a.alloc[:])
+	for spc := range a.partial {
+		clear(a.partial[spc])
+		a.partial[spc] = a.partial[spc][:0]
+	}
+	a.tiny = nil
+	a.tinyoffset = 0
+
+	live := a.allspans[:0]
+	for _, s := range a.allspans {
+		n := s.sweep()
+		objects += uint64(n)
+		bytes += uint64(n) * uint64(s.elemsize)
+		if s.spanclass.sizeclass() == 0 && s.allocCount == 0 {
+			// Release the large object span.
+			for p := uintptr(0); p < uintptr(len(s.data)); p += pageSize {
+				delete(a.spans, s.base()+p)
+			}
+			continue
+		}
+		live = append(live, s)
+		if s.allocCount < s.nelems {
+			a.partial[s.spanclass] = append(a.partial[s.spanclass], s)
+		}
+	}
+	clear(a.allspans[len(live):])
+	a.allspans = live
+	return objects, bytes
+}
+
+// sweep frees all of s's objects that aren't marked, and clears the mark
+// bits for the next cycle. It returns the number of objects freed.
+func (s *baseSpan) sweep() uintptr {
+	s.allocBits, s.gcmarkBits = s.gcmarkBits, s.allocBits
+	clear(s.gcmarkBits)
+	n := uintptr(0)
+	for _, b := range s.allocBits {
+		n += uintptr(bits.OnesCount8(b))
+	}
+	freed := s.allocCount - n
+	s.allocCount = n
+	s.freeindex = 0
+	s.allocCache = 0
+	s.needzero = true
+	return freed
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim"
+)
+
+func TestBaselineMake(t *testing.T) {
+	for _, size := range []uintptr{1, 7, 8, 12, 16, 24, 48, 200, 512, 520, 1024, 4096, 30000, 40000, 1 << 20} {
+		for _, ptrs := range []bool{false, true} {
+			if ptrs && size%8 != 0 {
+				continue
+			}
+			t.Run(fmt.Sprintf("size=%d/ptrs=%t", size, ptrs), func(t *testing.T) {
+				testBaselineMake(t, size, ptrs)
+			})
+		}
+	}
+}
+
+func TestBaselineMakeBadSize(t *testing.T) {
+	a := cpusim.NewBaselineAllocator()
+	typ := cpusim.FakeStruct(cpusim.FakePointer(), cpusim.FakeScalar(cpusim.PtrSize))
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Make of %d bytes of a %d-byte type with pointers didn't panic", typ.Size_+cpusim.PtrSize, typ.Size_)
+		}
+	}()
+	a.Make(typ.Size_+cpusim.PtrSize, typ)
+}
+
+func testBaselineMake(t *testing.T, size uintptr, ptrs bool) {
+	typ := cpusim.FakeScalar(size)
+	if ptrs {
+		// Use a type smaller than the object, so that it's treated as
+		// an array.
+		typ = cpusim.FakeStruct(cpusim.FakePointer(), cpusim.FakeScalar(8))
+		if size%typ.Size_ != 0 {
+			typ = cpusim.FakePointer()
+		}
+	}
+	n := max(2, int(64<<10/size))
+
+	a := cpusim.NewBaselineAllocator()
+	for round := range 2 {
+		var objs [][]byte
+		for i := range n {
+			p := a.Make(size, typ)
+			obj := unsafe.Slice((*byte)(p), size)
+			for j, c := range obj {
+				if c != 0 {
+					t.Fatalf("round %d: object %d not zeroed at offset %d", round, i, j)
+				}
+			}
+			if size >= 8 && uintptr(p)%8 != 0 {
+				t.Fatalf("object %p not 8-byte aligned", p)
+			}
+			if ptrs {
+				want := cpusim.TypePointerOffsets(typ, size)
+				if got := cpusim.BaselinePointerOffsets(a, p, size); !slices.Equal(got, want) {
+					t.Fatalf("object %d: pointer offsets = %v, want %v", i, got, want)
+				}
+			}
+			objs = append(objs, obj)
+		}
+		// Fill every object, and make sure none of them overlap.
+		for i, obj := range objs {
+			for j := range obj {
+				obj[j] = byte(i + 1)
+			}
+		}
+		for i, obj := range objs {
+			for j, c := range obj {
+				if c != byte(i+1) {
+					t.Fatalf("round %d: object %d overwritten at offset %d", round, i, j)
+				}
+			}
+		}
+		a.Reset()
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build (386 || amd64 || arm || arm64 || loong64 || mips64le || mipsle || ppc64le || riscv64 || wasm) && !purego
+
+package cpusim
+
+import "unsafe"
+
+// This file has fast paths for the bitmaps that rely on the platform being
+// little-endian, so that a bitmap may be accessed with loads and stores of
+// any width. bitmaps_portable.go has the equivalents for everything else.
+// Build with -tags purego to test those on a little-endian machine.
+
+// Read the bytes starting at the aligned pointer p into a uintptr.
+// Read is little-endian.
+func readUintptr(p *byte) uintptr {
+	return *(*uintptr)(unsafe.Pointer(p))
+}
+
+// setObjBit sets bit i of b's ObjBits.
+func (b *Block) setObjBit(i uintptr) {
+	b.data[BitmapSize+i/8] |= 1 << (i % 8)
+}
+
+// clearLineBits clears the bits of bitmap for every line set in lines.
+func clearLineBits(bitmap *[BitmapSize / 8]uint64, lines LineMask) {
+	// Make the math easier by reinterpreting the bitmap as bytes, so
+	// that each line's bits are a contiguous range of them.
+	const bytesPerLine = lineSize / minAlign / 8
+	bytes := (*[BitmapSize]byte)(unsafe.Pointer(&bitmap[0]))
+	lines.runs(func(i, n uintptr) {
+		clear(bytes[i*bytesPerLine : (i+n)*bytesPerLine])
+	})
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(386 || amd64 || arm || arm64 || loong64 || mips64le || mipsle || ppc64le || riscv64 || wasm) || purego
+
+package cpusim
+
+// Portable versions of the bitmap fast paths in bitmaps_little.go, which
+// only access bitmaps a uint64 at a time.
+
+// Read the bytes starting at the aligned pointer p into a uintptr.
+// Read is little-endian.
+func readUintptr(p *byte) uintptr {
+	var x uintptr
+	for i := uintptr(ptrSize); i > 0; i-- {
+		x = x<<8 | uintptr(*addb(p, i-1))
+	}
+	return x
+}
+
+// setObjBit sets bit i of b's ObjBits.
+func (b *Block) setObjBit(i uintptr) {
+	d := b.Meta()
+	d.ObjBits[i/64] |= 1 << (i % 64)
+}
+
+// clearLineBits clears the bits of bitmap for every line set in lines.
+func clearLineBits(bitmap *[BitmapSize / 8]uint64, lines LineMask) {
+	// Each word of ObjBits covers linesPerWord lines.
+	const bitsPerLine = lineSize / minAlign
+	const linesPerWord = 64 / bitsPerLine
+	for k := range bitmap {
+		var mask uint64
+		for j := range uintptr(linesPerWord) {
+			if lines.IsSet(uintptr(k)*linesPerWord + j) {
+				mask |= (^uint64(0) >> (64 - bitsPerLine)) << (j * bitsPerLine)
+			}
+		}
+		bitmap[k] &^= mask
+	}
+}
@@ -11,41 +11,61 @@ import (
 	"github.com/mknyszek/region-eval/cpusim/bitmath"
 )
 
+// escapeWork is the work stack for MarkEscaped, kept around so that it
+// only needs to be allocated once.
+var escapeWork []Pointer
+
+// MarkEscaped marks the object containing a as escaped, along with
+// everything transitively reachable from it in region memory.
+//
+// a must point into region memory. Pointers found in escaped objects that
+// point outside of region memory are ignored, as are pointers to objects
+// that have already escaped.
+//
+// MarkEscaped is not reentrant, and must not be called concurrently from
+// multiple goroutines.
 func MarkEscaped(a Pointer) {
 	if a == nil {
 		return
 	}
+	markEscaped1(a)
+	for len(escapeWork) != 0 {
+		a := escapeWork[len(escapeWork)-1]
+		escapeWork = escapeWork[:len(escapeWork)-1]
+		markEscaped1(a)
+	}
+}
+
+// markEscaped1 marks the object containing a as escaped and pushes any
+// objects it points to that still need to be marked onto escapeWork.
+func markEscaped1(a Pointer) {
+	// Large objects have their own blocks that span multiple
+	// BlockSize chunks, so the metadata can't be found by alignment.
+	if lb, ok := largeBlockOf(uintptr(a)); ok {
+		markEscapedLarge(lb)
+		return
+	}
 
 	// Pull out the block metadata.
-	base := bitmath.AlignDown(uintptr(a), BlockSize)
+	d := blockMeta(unsafe.Pointer(a))
+	base := uintptr(unsafe.Pointer(d))
 	objIdx := (uintptr(a) - base) / minAlign
-	d := (*BlockMeta)(unsafe.Pointer(base))
 
 	// Find the start of the object.
 	//
-	// Fast path: we're pointing to the start of the object (one word past the header).
-	objStart := Pointer(nil)
-	if objIdx != 0 && d.ObjBits[(objIdx-1)/64]&(1<<((objIdx-1)%64)) != 0 {
-		objIdx -= 1
-		objStart = Pointer(unsafe.Pointer(bitmath.AlignDown(uintptr(a), minAlign) - minAlign))
+	// Fast path: we're pointing to the start of the object (just past the header).
+	if i := objIdx - headerWords; objIdx >= headerWords && d.ObjBits[i/64]&(1<<(i%64)) != 0 {
+		objIdx = i
 	} else {
 		// We're not pointing to the start of the object.
-		mask := (uint64(1) << objIdx) - 1
-		n := uintptr(bits.LeadingZeros64(d.ObjBits[objIdx/64] & mask))
-
-		// Iterate until we find the next bit.
-		for n == 64 {
-			objIdx = bitmath.AlignDown(objIdx, 64) - 64
-			n = uintptr(bits.LeadingZeros64(d.ObjBits[objIdx/64]))
-		}
-		objIdx = bitmath.AlignDown(objIdx, 64) + 64 - n - 1
-		objStart = Pointer(unsafe.Pointer(base + objIdx*minAlign))
+		objIdx = prevObjBit(d, objIdx)
 	}
-	header := *(*uint64)(objStart)
-	size := uintptr(header>>48) * 8
+	objStart := base + objIdx*minAlign
+	header, addr := headerOf(d, objStart)
+	size := header.size()
 
 	// Set the escaped bits.
-	objEndIdx := objIdx + size/minAlign
+	objEndIdx := (addr+size-base)/minAlign - 1
 	if objIdx/64 == objEndIdx/64 {
 		// Fast path: small object that doesn't cross a bitmap word boundary.
 		d.EscBits[objIdx/64] |= ((uint64(1) << (objEndIdx - objIdx + 1)) - 1) << (objIdx % 64)
@@ -61,19 +81,55 @@ func MarkEscaped(a Pointer) {
 		d.EscBits[objEndIdx/64] |= (uint64(1) << (objEndIdx%64 + 1)) - 1
 	}
 
-	// Set the line escape bits.
-	objLine := (uintptr(a) - base) / lineSize
-	objEndLine := (uintptr(a) + size - base) / lineSize
-	d.LineEscape |= uint64(1) << (objEndLine - objLine) << objLine
+	// Set the line escape bits for every line the object touches.
+	objLine := (objStart - base) / lineSize
+	objEndLine := (addr + size - 1 - base) / lineSize
+	d.LineEscape.setRange(objLine, objEndLine-objLine+1)
 
 	// Nothing to transitively mark escaped.
-	typ := (*FakeType)(unsafe.Pointer(uintptr(header & ((uint64(1) << 48) - 1))))
+	typ := header.typ()
 	if typ.PtrBytes == 0 {
 		return
 	}
 
-	// Iterate over the object's pointers and transitively mark anything escaped.
-	addr := uintptr(objStart) + headerSize
+	// Iterate over the object's pointers and queue anything that needs
+	// to be transitively marked escaped.
+	markEscapedPointers(d, typ, addr, size)
+}
+
+// prevObjBit returns the index of the last bit set in d's ObjBits at or
+// before i, which is the start of the object containing word i.
+func prevObjBit(d *BlockMeta, i uintptr) uintptr {
+	mask := (uint64(2) << (i % 64)) - 1
+	n := uintptr(bits.LeadingZeros64(d.ObjBits[i/64] & mask))
+
+	// Iterate until we find the next bit.
+	for n == 64 {
+		i = bitmath.AlignDown(i, 64) - 64
+		n = uintptr(bits.LeadingZeros64(d.ObjBits[i/64]))
+	}
+	return bitmath.AlignDown(i, 64) + 64 - n - 1
+}
+
+// regionObjectOf returns the address, size and type of the object
+// containing p, which must point into region memory.
+func regionObjectOf(p unsafe.Pointer) (addr unsafe.Pointer, size uintptr, typ *FakeType) {
+	if lb, ok := largeBlockOf(uintptr(p)); ok {
+		d := lb.meta
+		header, a := headerOf(d, lb.start)
+		return d.at(a), lb.limit - a, header.typ()
+	}
+	d := blockMeta(p)
+	base := uintptr(unsafe.Pointer(d))
+	objIdx := prevObjBit(d, (uintptr(p)-base)/minAlign)
+	header, a := headerOf(d, base+objIdx*minAlign)
+	return d.at(a), header.size(), header.typ()
+}
+
+// markEscapedPointers queues everything pointed to by the object of type
+// typ at addr with the given size, in the block with metadata d, that
+// still needs to be marked escaped.
+func markEscapedPointers(d *BlockMeta, typ *FakeType, addr, size uintptr) {
 	limit := addr + size
 	tp := typePointers{elem: addr, addr: addr, mask: readUintptr(typ.GCData), typ: typ}
 	for {
@@ -83,14 +139,90 @@ func MarkEscaped(a Pointer) {
 				break
 			}
 		}
-		ptr := *(*uintptr)(unsafe.Pointer(addr))
-		if ptr != 0 {
-			println("start", unsafe.Pointer(objStart), unsafe.Pointer(addr))
-			println(unsafe.Pointer(ptr), unsafe.Pointer(typ))
-			panic("expected zeroed memory")
+		ptr := *(*unsafe.Pointer)(d.at(addr))
+		if ptr == nil || !isRegionMemory(uintptr(ptr)) || isEscaped(ptr) {
+			continue
 		}
+		escapeWork = append(escapeWork, Pointer(ptr))
+	}
+}
+
+// WriteKind classifies a pointer write by whether the pointer being
+// written, its source, and the slot it's written to, its destination,
+// are in region memory. Each kind takes a different path through
+// RegionWriteBarrierFastPath. Writes of nil have no source.
+type WriteKind int
+
+const (
+	WriteNeither   WriteKind = iota // Neither is in region memory.
+	WriteDstRegion                  // Only the slot is in region memory.
+	WriteSrcRegion                  // Only the pointer points into region memory.
+	WriteBoth                       // Both are in region memory.
+	NumWriteKinds
+)
+
+func (k WriteKind) String() string {
+	switch k {
+	case WriteNeither:
+		return "Neither"
+	case WriteDstRegion:
+		return "DstRegion"
+	case WriteSrcRegion:
+		return "SrcRegion"
+	case WriteBoth:
+		return "Both"
+	}
+	return "unknown"
+}
+
+// ClassifyWrite returns the kind of the pointer write *slot = ptr.
+func ClassifyWrite(slot, ptr unsafe.Pointer) WriteKind {
+	k := WriteNeither
+	if isRegionMemory(uintptr(slot)) {
+		k |= WriteDstRegion
+	}
+	if ptr != nil && isRegionMemory(uintptr(ptr)) {
+		k |= WriteSrcRegion
+	}
+	return k
+}
+
+// WritePointer performs the pointer write *slot = ptr, including the
+// region write barrier, and returns the kind of the write.
+//
+// RegionWriteBarrierFastPath only simulates the cost of the barrier. This
+// also does the work of its slow path, which is to mark ptr escaped if it
+// points into a region and slot is either outside of region memory or in
+// an escaped object. Writes between different regions are not handled.
+func WritePointer(slot, ptr unsafe.Pointer) WriteKind {
+	RegionWriteBarrierFastPath(ptr, slot)
+	*(*unsafe.Pointer)(slot) = ptr
+	k := ClassifyWrite(slot, ptr)
+	if k&WriteSrcRegion == 0 || isEscaped(ptr) {
+		return k
+	}
+	if k&WriteDstRegion == 0 || isEscaped(slot) {
 		MarkEscaped(Pointer(ptr))
 	}
+	return k
+}
+
+// IsEscaped returns whether p points into an escaped object in region
+// memory.
+func IsEscaped(p Pointer) bool {
+	return p != nil && isRegionMemory(uintptr(p)) && isEscaped(unsafe.Pointer(p))
+}
+
+// isEscaped returns whether the object containing p, which must point
+// into region memory, has escaped.
+func isEscaped(p unsafe.Pointer) bool {
+	if lb, ok := largeBlockOf(uintptr(p)); ok {
+		return !lb.meta.LineEscape.IsZero()
+	}
+	// Escape bits cover whole objects, so any word of the object will do.
+	d := blockMeta(p)
+	i := (uintptr(p) - uintptr(unsafe.Pointer(d))) / minAlign
+	return d.EscBits[i/64]&(uint64(1)<<(i%64)) != 0
 }
 
 const AddrSpace = 1 << 48
@@ -116,19 +248,20 @@ func RegionWriteBarrierFastPath(ptr, dst unsafe.Pointer) {
 	}
 	dstArena := uintptr(dst) / HeapArenaBytes
 	if ptrArena == dstArena || IsRegionArena[dstArena/64]&(uint64(1)<<(dstArena%64)) != 0 {
-		base := uintptr(dst) &^ (8192 - 1)
-		if *(*uintptr)(unsafe.Pointer((uintptr(ptr) &^ (8192 - 1)) + 256 + 8)) != *(*uintptr)(unsafe.Pointer(base + 256 + 8)) {
+		off := uintptr(dst) & (BlockSize - 1)
+		base := unsafe.Add(dst, -int(off))
+		if *(*uint64)(unsafe.Add(ptr, int(regionOffset)-int(uintptr(ptr)&(BlockSize-1)))) != *(*uint64)(unsafe.Add(base, regionOffset)) {
 			dummyMarkEscaped(ptr)
 			return
 		}
-		word := (uintptr(dst) - base) / 8
-		if *(*uint64)(unsafe.Pointer(base + word/64))&(1<<(word%64)) == 0 {
+		word := off / 8
+		if *(*uint64)(unsafe.Add(base, word/64))&(1<<(word%64)) == 0 {
 			return
 		}
 	}
-	base := uintptr(ptr) &^ (8192 - 1)
-	word := (uintptr(ptr) - base) / 8
-	if *(*uint64)(unsafe.Pointer(base + word/64))&(1<<(word%64)) != 0 {
+	off := uintptr(ptr) & (BlockSize - 1)
+	word := off / 8
+	if *(*uint64)(unsafe.Add(ptr, int(word/64)-int(off)))&(1<<(word%64)) != 0 {
 		return
 	}
 	dummyMarkEscaped(ptr)
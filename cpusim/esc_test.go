@@ -7,8 +7,8 @@ package cpusim_test
 import (
 	"fmt"
 	"math/rand/v2"
+	"reflect"
 	"runtime"
-	"syscall"
 	"testing"
 	"unsafe"
 
@@ -46,58 +46,101 @@ func BenchmarkEscape(b *testing.B) {
 
 func benchEscape(b *testing.B, size uintptr, ptrPercent int) {
 	b.Run(fmt.Sprintf("bytes=%d", size), func(b *testing.B) {
-		cs := perfbench.Open(b)
+		benchEscapeType(b, makeFakeType(size, ptrPercent))
+	})
+}
 
-		a := cpusim.NewAllocator(nil)
-		ft := makeFakeType(size, ptrPercent)
-
-		// Allocate a whole bunch of things to escape, up to half the ballast.
-		escapes := make([]cpusim.Pointer, 0, 2*len(ballast)/int(size))
-		var total uintptr
-		for {
-			x := a.Make(size, ft)
-			if alwaysFalse {
-				sink = x
-			}
-			escapes = append(escapes, x)
-			total += 8 + size
-			if total > uintptr(len(ballast)/2) {
-				break
-			}
+// Types that look like what real programs allocate.
+type (
+	escapeNode struct {
+		key   string
+		value []byte
+		left  *escapeNode
+		right *escapeNode
+		hash  uint64
+	}
+	escapeRequest struct {
+		method, path string
+		header       map[string][]string
+		body         []byte
+		ctx          interface{}
+		id           int64
+		deadline     int64
+		attrs        [4]struct {
+			key string
+			val int64
 		}
+	}
+)
 
-		// Shuffle up the pointers so we get plenty of cache misses.
-		r := rand.New(rand.NewPCG(0, 0))
-		r.Shuffle(len(escapes), func(i, j int) {
-			escapes[i], escapes[j] = escapes[j], escapes[i]
+func BenchmarkEscapeTypes(b *testing.B) {
+	ballast = make([]byte, llcBytes)
+	defer func() { ballast = nil }()
+
+	for _, typ := range []reflect.Type{
+		reflect.TypeFor[escapeNode](),
+		reflect.TypeFor[escapeRequest](),
+		reflect.TypeFor[[16]escapeNode](),
+		reflect.TypeFor[[64]int64](),
+	} {
+		b.Run(fmt.Sprintf("type=%s", typ), func(b *testing.B) {
+			benchEscapeType(b, cpusim.FakeTypeOf(typ))
 		})
+	}
+}
 
-		// Run a GC now to avoid having one trigger later from some small allocation.
-		runtime.GC()
-
-		var mstats runtime.MemStats
-		runtime.ReadMemStats(&mstats)
-		startGCs := mstats.NumGC
+func benchEscapeType(b *testing.B, ft *cpusim.FakeType) {
+	size := ft.Size_
+	cs := perfbench.Open(b)
 
-		b.ResetTimer()
-		cs.Reset()
+	a := cpusim.NewAllocator(nil)
 
-		for i := range b.N {
-			cpusim.MarkEscaped(escapes[i%len(escapes)])
+	// Allocate a whole bunch of things to escape, up to half the ballast.
+	escapes := make([]cpusim.Pointer, 0, 2*len(ballast)/int(size))
+	var total uintptr
+	for {
+		x := a.Make(size, ft)
+		if alwaysFalse {
+			sink = x
 		}
+		escapes = append(escapes, x)
+		total += cpusim.HeaderSize + size
+		if total > uintptr(len(ballast)/2) {
+			break
+		}
+	}
 
-		cs.Stop()
-		b.StopTimer()
+	// Shuffle up the pointers so we get plenty of cache misses.
+	r := rand.New(rand.NewPCG(0, 0))
+	r.Shuffle(len(escapes), func(i, j int) {
+		escapes[i], escapes[j] = escapes[j], escapes[i]
+	})
 
-		reportPerByte(b, size, cs)
+	// Run a GC now to avoid having one trigger later from some small allocation.
+	runtime.GC()
 
-		// Confirm that no automatic GCs happened during the benchmark.
-		runtime.ReadMemStats(&mstats)
-		endGCs := mstats.NumGC
-		if endGCs != startGCs {
-			b.Fatalf("%d unaccounted GCs", endGCs-startGCs)
-		}
-	})
+	var mstats runtime.MemStats
+	runtime.ReadMemStats(&mstats)
+	startGCs := mstats.NumGC
+
+	b.ResetTimer()
+	cs.Reset()
+
+	for i := range b.N {
+		cpusim.MarkEscaped(escapes[i%len(escapes)])
+	}
+
+	cs.Stop()
+	b.StopTimer()
+
+	reportPerByte(b, size, cs)
+
+	// Confirm that no automatic GCs happened during the benchmark.
+	runtime.ReadMemStats(&mstats)
+	endGCs := mstats.NumGC
+	if endGCs != startGCs {
+		b.Fatalf("%d unaccounted GCs", endGCs-startGCs)
+	}
 }
 
 func makeFakeType(size uintptr, ptrPercent int) *cpusim.FakeType {
@@ -151,7 +194,7 @@ func testMarkEscaped(t *testing.T, size, offset uintptr, ptrs bool) {
 	}
 	b := a.BlockOf(x)
 	d := b.Meta()
-	ws := (uintptr(x)-b.Base())/8 - 1
+	ws := (uintptr(x) - cpusim.HeaderSize - b.Base()) / 8
 	we := (uintptr(x) + size - b.Base()) / 8
 
 	// Check that the before state makes sense.
@@ -196,6 +239,74 @@ func testMarkEscaped(t *testing.T, size, offset uintptr, ptrs bool) {
 			t.Fatalf("found escape bit %d incorrectly set", i)
 		}
 	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	setup := func(t *testing.T) (a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+		a = cpusim.NewAllocator(nil)
+		ft := makeFakeType(240, 100)
+		escaped = a.Make(240, ft)
+		other = a.Make(240, ft)
+		cpusim.MarkEscaped(escaped)
+		if err := a.Verify(); err != nil {
+			t.Fatalf("unexpected error before corruption: %v", err)
+		}
+		return a, escaped, other
+	}
+	wordOf := func(b *cpusim.Block, p cpusim.Pointer) uintptr {
+		return (uintptr(p) - b.Base()) / 8
+	}
+	for _, tc := range []struct {
+		name    string
+		corrupt func(a *cpusim.Allocator, escaped, other cpusim.Pointer)
+	}{
+		{"PartialEscape", func(a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+			b := a.BlockOf(escaped)
+			i := wordOf(b, escaped) + 3
+			b.Meta().EscBits[i/64] &^= 1 << (i % 64)
+		}},
+		{"StrayEscapeBit", func(a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+			b := a.BlockOf(escaped)
+			i := wordOf(b, other) + 30 + 8 // Past the end of other.
+			b.Meta().EscBits[i/64] |= 1 << (i % 64)
+		}},
+		{"MissingLineEscape", func(a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+			a.BlockOf(escaped).Meta().LineEscape = cpusim.LineMask{}
+		}},
+		{"ExtraLineEscape", func(a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+			b := a.BlockOf(escaped)
+			b.Meta().LineEscape.Set(uintptr(len(b.Lines()) - 1))
+		}},
+		{"OverlappingObject", func(a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+			b := a.BlockOf(other)
+			i := wordOf(b, other) + 2
+			b.Meta().ObjBits[i/64] |= 1 << (i % 64)
+		}},
+		{"BadHeader", func(a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+			cpusim.SetBadHeader(a.BlockOf(other), other)
+		}},
+		{"PointerToNonEscaped", func(a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+			*(*uintptr)(unsafe.Pointer(escaped)) = uintptr(other)
+		}},
+		{"PointerOutsideAllocator", func(a *cpusim.Allocator, escaped, other cpusim.Pointer) {
+			// Like a pointer into a block that was dropped and reused.
+			b := cpusim.NewBlock(cpusim.LineMask{})
+			*(*uintptr)(unsafe.Pointer(escaped)) = b.Base() + cpusim.BlockSize/2
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, escaped, other := setup(t)
+			tc.corrupt(a, escaped, other)
+			err := a.Verify()
+			if err == nil {
+				t.Fatal("expected verification error")
+			}
+			t.Log(err)
+		})
+	}
 }
 
 func isSet(b *[cpusim.BitmapSize / 8]uint64, i uintptr) bool {
@@ -213,47 +324,11 @@ func BenchmarkWriteBarrier(b *testing.B) {
 }
 
 func benchWriteBarrier(b *testing.B, preEscPercent int, shuffle bool) {
-	cs := perfbench.Open(b)
-
-	dataSize := 1 << 30
-	data, err := syscall.Mmap(-1, 0, dataSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
-	if err != nil {
-		b.Fatal(err)
-	}
-	addr := uintptr(unsafe.Pointer(&data[0]))
-	for i := addr; i < addr+uintptr(dataSize)+cpusim.HeapArenaBytes; i += cpusim.HeapArenaBytes {
-		arenaIdx := i / cpusim.HeapArenaBytes
-		cpusim.IsRegionArena[arenaIdx/64] |= uint64(1) << (arenaIdx % 64)
-	}
-	defer func() {
-		syscall.Munmap(data)
-		for i := range cpusim.IsRegionArena {
-			cpusim.IsRegionArena[i] = 0
-		}
-	}()
-
-	// The cpusim code assumes BlockSize-aligned memory, but mmap may not return memory with sufficient alignment.
-	// Since we have plenty of blocks, align it up ourselves.
-	alignedData := data
-	if bitmath.AlignDown(addr, cpusim.BlockSize) != addr {
-		offset := bitmath.AlignUp(addr, cpusim.BlockSize) - addr
-		alignedData = data[offset:]
-	}
-
-	// Split the mmap'd data into blocks.
-	var blocks []*cpusim.Block
-	for i := 0; i < len(alignedData); i += cpusim.BlockSize {
-		if len(alignedData[i:]) < cpusim.BlockSize {
-			break
-		}
-		blocks = append(blocks, cpusim.NewBlockFromExisting(0, 0, (*[cpusim.BlockSize]byte)(alignedData[i:i+cpusim.BlockSize])))
-	}
-
 	const fp = 64 << 10
 	const sz = 64
 	const n = fp / sz
-	size := uintptr(sz) - 8 // Total size is 64 for each alloc.
-	a := cpusim.NewAllocator(blocks)
+	size := uintptr(sz) - cpusim.HeaderSize // Total size is 64 for each alloc.
+	a := cpusim.NewAllocator(nil)
 	ft := makeFakeType(size, 100)
 
 	// Allocate a whole bunch of things to escape.
@@ -285,6 +360,59 @@ func benchWriteBarrier(b *testing.B, preEscPercent int, shuffle bool) {
 			dsts = append(dsts, x)
 		}
 	}
+	runWriteBarrier(b, size, srcs, dsts)
+}
+
+// BenchmarkWriteBarrierKinds measures the write barrier for each kind of
+// write, by whether the pointer written and the slot written to are in
+// region memory. None of the region objects have escaped.
+func BenchmarkWriteBarrierKinds(b *testing.B) {
+	for k := range cpusim.NumWriteKinds {
+		b.Run(fmt.Sprintf("kind=%s", k), func(b *testing.B) {
+			benchWriteBarrierKind(b, k)
+		})
+	}
+}
+
+func benchWriteBarrierKind(b *testing.B, kind cpusim.WriteKind) {
+	const fp = 64 << 10
+	const sz = 64
+	const n = fp / sz
+	size := uintptr(sz) - cpusim.HeaderSize
+	a := cpusim.NewAllocator(nil)
+	ft := makeFakeType(size, 100)
+	heap := make([]uintptr, 2*n*sz/8)
+	if arena := uintptr(unsafe.Pointer(&heap[0])) / cpusim.HeapArenaBytes; cpusim.IsRegionArena[arena/64]&(1<<(arena%64)) != 0 {
+		b.Skip("heap memory shares an arena with region memory")
+	}
+
+	objs := func(region bool) []unsafe.Pointer {
+		objs := make([]unsafe.Pointer, 0, n)
+		for i := range n {
+			if region {
+				objs = append(objs, unsafe.Pointer(a.Make(size, ft)))
+			} else {
+				objs = append(objs, unsafe.Pointer(&heap[i*sz/8]))
+			}
+		}
+		return objs
+	}
+	srcs := objs(kind&cpusim.WriteSrcRegion != 0)
+	if kind&cpusim.WriteSrcRegion == 0 {
+		heap = heap[n*sz/8:]
+	}
+	dsts := objs(kind&cpusim.WriteDstRegion != 0)
+	if got := cpusim.ClassifyWrite(dsts[0], srcs[0]); got != kind {
+		b.Fatalf("benchmarking %s writes, but got %s", kind, got)
+	}
+	runWriteBarrier(b, size, srcs, dsts)
+}
+
+// runWriteBarrier times writing srcs[i] into dsts[i] with the write
+// barrier fast path, cycling through them.
+func runWriteBarrier(b *testing.B, size uintptr, srcs, dsts []unsafe.Pointer) {
+	cs := perfbench.Open(b)
+	n := len(srcs)
 
 	// Run a GC now to avoid having one trigger later from some small allocation.
 	runtime.GC()
@@ -314,3 +442,169 @@ func benchWriteBarrier(b *testing.B, preEscPercent int, shuffle bool) {
 		b.Fatalf("%d unaccounted GCs", endGCs-startGCs)
 	}
 }
+
+// makeNodeType returns a type of the given size whose first nptrs words
+// are pointers.
+func makeNodeType(size uintptr, nptrs int) *cpusim.FakeType {
+	var fields []*cpusim.FakeType
+	for range nptrs {
+		fields = append(fields, cpusim.FakePointer())
+	}
+	fields = append(fields, cpusim.FakeScalar(size-uintptr(nptrs)*cpusim.PtrSize))
+	return cpusim.FakeStruct(fields...)
+}
+
+func setPtr(obj cpusim.Pointer, i int, ptr unsafe.Pointer) {
+	*(*unsafe.Pointer)(unsafe.Add(unsafe.Pointer(obj), i*cpusim.PtrSize)) = ptr
+}
+
+func isEscaped(a *cpusim.Allocator, x cpusim.Pointer) bool {
+	for obj := range a.BlockOf(x).EscapedObjects() {
+		if obj.Addr == x {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegionArenas(t *testing.T) {
+	a := cpusim.NewAllocator(nil)
+	small := a.Make(64, makeFakeType(64, 0))
+	large := a.Make(3*cpusim.BlockSize, makeFakeType(3*cpusim.BlockSize, 0))
+	heap := new([8]uintptr)
+
+	isRegionArena := func(p unsafe.Pointer) bool {
+		arena := uintptr(p) / cpusim.HeapArenaBytes
+		return cpusim.IsRegionArena[arena/64]&(uint64(1)<<(arena%64)) != 0
+	}
+	for _, p := range []cpusim.Pointer{small, large, cpusim.Pointer(unsafe.Add(unsafe.Pointer(large), 2*cpusim.BlockSize))} {
+		if !isRegionArena(unsafe.Pointer(p)) {
+			t.Errorf("region memory at %p not in a region arena", p)
+		}
+	}
+	if isRegionArena(unsafe.Pointer(heap)) {
+		t.Fatal("heap memory in a region arena")
+	}
+	if got := cpusim.ClassifyWrite(unsafe.Pointer(heap), unsafe.Pointer(small)); got != cpusim.WriteSrcRegion {
+		t.Errorf("got %s for a heap slot and region pointer, want %s", got, cpusim.WriteSrcRegion)
+	}
+
+	// An interior pointer past the first chunk of a large object finds
+	// the object's metadata.
+	cpusim.MarkEscaped(cpusim.Pointer(unsafe.Add(unsafe.Pointer(large), 2*cpusim.BlockSize+8)))
+	if !cpusim.IsEscaped(large) || cpusim.IsEscaped(small) {
+		t.Error("escaping a large object via an interior pointer escaped the wrong objects")
+	}
+}
+
+func TestMarkEscapedTransitive(t *testing.T) {
+	node := makeNodeType(32, 2)
+	check := func(t *testing.T, a *cpusim.Allocator, reachable, unreachable []cpusim.Pointer) {
+		t.Helper()
+		for _, x := range reachable {
+			if !isEscaped(a, x) {
+				t.Fatalf("reachable object %p not escaped", x)
+			}
+		}
+		for _, x := range unreachable {
+			if isEscaped(a, x) {
+				t.Fatalf("unreachable object %p escaped", x)
+			}
+		}
+		if err := a.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("LinkedList", func(t *testing.T) {
+		// Long enough to span many blocks and to blow up a recursive
+		// implementation.
+		const n = 200000
+		a := cpusim.NewAllocator(nil)
+		nodes := make([]cpusim.Pointer, n)
+		for i := range nodes {
+			nodes[i] = a.Make(32, node)
+			if i > 0 {
+				setPtr(nodes[i-1], 0, unsafe.Pointer(nodes[i]))
+			}
+		}
+		// Escape from the middle, via an interior pointer.
+		cpusim.MarkEscaped(cpusim.Pointer(uintptr(nodes[n/2]) + 20))
+		check(t, a, nodes[n/2:], nodes[:n/2])
+	})
+	t.Run("Tree", func(t *testing.T) {
+		a := cpusim.NewAllocator(nil)
+		var nodes []cpusim.Pointer
+		var build func(depth int) cpusim.Pointer
+		build = func(depth int) cpusim.Pointer {
+			x := a.Make(32, node)
+			nodes = append(nodes, x)
+			if depth > 0 {
+				setPtr(x, 0, unsafe.Pointer(build(depth-1)))
+				setPtr(x, 1, unsafe.Pointer(build(depth-1)))
+			}
+			return x
+		}
+		build(12)
+
+		// nodes is in pre-order, so the left subtree of the root is
+		// nodes[1:1+len(nodes)/2].
+		left := nodes[1 : 1+len(nodes)/2]
+		cpusim.MarkEscaped(left[0])
+		check(t, a, left, append([]cpusim.Pointer{nodes[0]}, nodes[1+len(nodes)/2:]...))
+	})
+	t.Run("Cycle", func(t *testing.T) {
+		a := cpusim.NewAllocator(nil)
+		var cycle []cpusim.Pointer
+		for range 100 {
+			cycle = append(cycle, a.Make(32, node))
+		}
+		for i := range cycle {
+			setPtr(cycle[i], 0, unsafe.Pointer(cycle[(i+1)%len(cycle)]))
+			setPtr(cycle[i], 1, unsafe.Pointer(cycle[i])) // Self-loop.
+		}
+		other := a.Make(32, node)
+		cpusim.MarkEscaped(cycle[42])
+		check(t, a, cycle, []cpusim.Pointer{other})
+	})
+	t.Run("AlreadyEscaped", func(t *testing.T) {
+		a := cpusim.NewAllocator(nil)
+		x, y, z := a.Make(32, node), a.Make(32, node), a.Make(32, node)
+		cpusim.MarkEscaped(y)
+		// y has already escaped, so z shouldn't be found through it,
+		// even though that breaks the invariant.
+		setPtr(x, 0, unsafe.Pointer(y))
+		setPtr(y, 0, unsafe.Pointer(z))
+		cpusim.MarkEscaped(x)
+		if !isEscaped(a, x) || !isEscaped(a, y) {
+			t.Fatal("x or y not escaped")
+		}
+		if isEscaped(a, z) {
+			t.Fatal("marking traversed an already-escaped object")
+		}
+	})
+	t.Run("NonRegion", func(t *testing.T) {
+		a := cpusim.NewAllocator(nil)
+		x, y := a.Make(32, node), a.Make(32, node)
+		heap := new([64]byte)
+		setPtr(x, 0, unsafe.Pointer(heap))
+		setPtr(x, 1, unsafe.Pointer(y))
+		cpusim.MarkEscaped(x)
+		check(t, a, []cpusim.Pointer{x, y}, nil)
+		runtime.KeepAlive(heap)
+	})
+	t.Run("Large", func(t *testing.T) {
+		a := cpusim.NewAllocator(nil)
+		const n = 8192
+		big := a.Make(n*8, makeNodeType(n*8, n))
+		var small []cpusim.Pointer
+		for i := range 100 {
+			x := a.Make(32, node)
+			setPtr(big, i*(n/100), unsafe.Pointer(x))
+			small = append(small, x)
+		}
+		setPtr(small[0], 0, unsafe.Pointer(big))
+		cpusim.MarkEscaped(small[0])
+		check(t, a, append(small, big), nil)
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+const (
+	LineSize     = lineSize
+	HeaderSize   = headerSize
+	MaxSmallSize = maxSmallSize
+	MetaSize     = metaSize
+)
+
+// SetBadHeader replaces the header of the object at p in b with one that
+// has a nil type and a huge size.
+func SetBadHeader(b *Block, p Pointer) {
+	setHeader(b.Meta(), uintptr(p)-headerSize, 0xffff<<48)
+}
+
+// TypePointerOffsets returns the offsets of the pointers that
+// typePointers finds in an object of type typ with the given size.
+func TypePointerOffsets(typ *FakeType, size uintptr) []uintptr {
+	if typ.PtrBytes == 0 {
+		return nil
+	}
+	// The iterator never dereferences the object, so any nonzero base
+	// will do.
+	const base = BlockSize
+	limit := base + size
+	tp := typePointers{elem: base, addr: base, mask: readUintptr(typ.GCData), typ: typ}
+	var offs []uintptr
+	for {
+		var addr uintptr
+		if tp, addr = tp.nextFast(); addr == 0 {
+			if tp, addr = tp.next(limit); addr == 0 {
+				break
+			}
+		}
+		offs = append(offs, addr-base)
+	}
+	return offs
+}
+
+// RuntimeGCMaskBuilt reports whether the runtime has a pointer bitmap
+// for t that FakeTypeOf can check against.
+func RuntimeGCMaskBuilt(t reflect.Type) bool {
+	rt := abiTypeOf(t)
+	return rt.PtrBytes == 0 || rt.runtimeGCMask() != nil
+}
+
+var CheckAgainstRuntime = checkAgainstRuntime
+
+// BaselinePointerOffsets returns the offsets of the pointers that a
+// BaselineAllocator recorded for the object of the given size at p.
+func BaselinePointerOffsets(a *BaselineAllocator, p Pointer, size uintptr) []uintptr {
+	x := uintptr(p)
+	if s := a.spanOf(x); s != nil {
+		switch {
+		case s.spanclass.sizeclass() == 0:
+			if s.largeType == nil {
+				return nil
+			}
+			return TypePointerOffsets(s.largeType, size)
+		case s.spanclass.noscan():
+			return nil
+		case heapBitsInSpan(s.elemsize):
+			var offs []uintptr
+			hb := s.heapBits()
+			for off := uintptr(0); off < size; off += ptrSize {
+				w := (x - s.base() + off) / ptrSize
+				if hb[w/ptrBits]&(1<<(w%ptrBits)) != 0 {
+					offs = append(offs, off)
+				}
+			}
+			return offs
+		default:
+			return TypePointerOffsets(*(**FakeType)(unsafe.Add(unsafe.Pointer(p), -mallocHeaderSize)), size)
+		}
+	}
+	panic("object not allocated by the baseline allocator")
+}
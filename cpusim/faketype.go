@@ -4,14 +4,30 @@
 
 package cpusim
 
-import "github.com/mknyszek/region-eval/cpusim/bitmath"
+import (
+	"fmt"
+	"reflect"
 
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// FakeType stands in for internal/abi.Type. Only the fields cpusim uses
+// are named, and those are where abi.Type keeps them.
 type FakeType struct {
 	Size_    uintptr
 	PtrBytes uintptr
-	_        [5]uintptr
+	_        uint32   // Hash
+	_        uint8    // TFlag
+	Align_   uint8    // Alignment of objects of this type. 0 means minAlign.
+	_        [2]uint8 // FieldAlign_, Kind_
+	_        uintptr  // Equal
 	GCData   *byte
-	_        [1]uintptr
+	_        [2]int32 // Str, PtrToThis
+}
+
+// align returns the alignment of objects of type t.
+func (t *FakeType) align() uintptr {
+	return max(uintptr(t.Align_), minAlign)
 }
 
 var allFakeTypes []*FakeType
@@ -35,3 +51,146 @@ func NewFakeType(size, ptrs uintptr, gcdata []byte) *FakeType {
 	allFakeTypes = append(allFakeTypes, typ)
 	return typ
 }
+
+// The functions below build FakeTypes out of other FakeTypes, computing
+// PtrBytes and GCData along the way. Layouts are modeled at word
+// granularity: every FakeType's size is a multiple of the pointer size,
+// so fields smaller than a word take up a whole word.
+
+var fakePointer = fakeTypeFromMask(ptrSize, []bool{true})
+
+// FakePointer returns a pointer-sized type that is a pointer.
+func FakePointer() *FakeType {
+	return fakePointer
+}
+
+// FakeScalar returns a type of the given size with no pointers.
+func FakeScalar(size uintptr) *FakeType {
+	return NewFakeType(size, 0, nil)
+}
+
+// FakeStruct returns a struct type with the given fields, laid out in
+// order with no padding beyond rounding each field to the pointer size,
+// or to its alignment if that's larger. The struct is as aligned as its
+// most aligned field.
+func FakeStruct(fields ...*FakeType) *FakeType {
+	var (
+		mask  []bool
+		align uintptr
+	)
+	for _, f := range fields {
+		if uintptr(f.Align_) > ptrSize {
+			pad := bitmath.AlignUp(uintptr(len(mask))*ptrSize, uintptr(f.Align_))/ptrSize - uintptr(len(mask))
+			mask = append(mask, make([]bool, pad)...)
+		}
+		mask = append(mask, f.ptrMask(f.Size_)...)
+		align = max(align, uintptr(f.Align_))
+	}
+	size := bitmath.AlignUp(uintptr(len(mask))*ptrSize, max(align, ptrSize))
+	return withAlign(fakeTypeFromMask(size, mask), align)
+}
+
+// FakeArray returns an array type of n elements of type elem.
+func FakeArray(elem *FakeType, n uintptr) *FakeType {
+	var mask []bool
+	for range n {
+		mask = append(mask, elem.ptrMask(elem.Size_)...)
+	}
+	return withAlign(fakeTypeFromMask(n*elem.Size_, mask), uintptr(elem.Align_))
+}
+
+// FakeAligned returns a type like t, but aligned to align, which must be
+// a power of two no larger than 128, as in internal/abi.Type. Its size is rounded up to a multiple of align, like Go
+// does for every type.
+func FakeAligned(t *FakeType, align uintptr) *FakeType {
+	if align == 0 || align&(align-1) != 0 || align > 128 {
+		panic("alignment must be a power of two no larger than 128")
+	}
+	return withAlign(fakeTypeFromMask(bitmath.AlignUp(t.Size_, align), t.ptrMask(t.Size_)), align)
+}
+
+// FakeFromReflect returns a type with the same size, alignment and
+// pointer layout as t, derived from t's structure.
+func FakeFromReflect(t reflect.Type) *FakeType {
+	mask := make([]bool, bitmath.AlignUp(t.Size(), ptrSize)/ptrSize)
+	reflectPtrMask(t, 0, mask)
+	return withAlign(fakeTypeFromMask(t.Size(), mask), uintptr(t.Align()))
+}
+
+// withAlign sets t's alignment, if it's stricter than minAlign, and
+// returns t.
+func withAlign(t *FakeType, align uintptr) *FakeType {
+	if align > minAlign {
+		t.Align_ = uint8(align)
+	}
+	return t
+}
+
+// reflectPtrMask sets the words of mask that are pointers in a value of
+// type t at offset off.
+func reflectPtrMask(t reflect.Type, off uintptr, mask []bool) {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.UnsafePointer, reflect.Map, reflect.Chan, reflect.Func:
+		mask[off/ptrSize] = true
+	case reflect.String, reflect.Slice:
+		// The data pointer comes first.
+		mask[off/ptrSize] = true
+	case reflect.Interface:
+		// Only the data word. The type/itab word always points to
+		// memory the GC doesn't manage.
+		mask[off/ptrSize+1] = true
+	case reflect.Array:
+		for i := 0; i < t.Len(); i++ {
+			reflectPtrMask(t.Elem(), off+uintptr(i)*t.Elem().Size(), mask)
+		}
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			reflectPtrMask(f.Type, off+f.Offset, mask)
+		}
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+	default:
+		panic(fmt.Sprintf("unsupported kind %v", t.Kind()))
+	}
+}
+
+// fakeTypeFromMask returns a new FakeType of the given size whose pointer
+// words are those set in mask.
+func fakeTypeFromMask(size uintptr, mask []bool) *FakeType {
+	nptrWords := 0
+	for i, isPtr := range mask {
+		if isPtr {
+			nptrWords = i + 1
+		}
+	}
+	var gcdata []byte
+	if nptrWords != 0 {
+		gcdata = make([]byte, bitmath.AlignUp(uintptr(nptrWords+7)/8, ptrSize))
+		for i, isPtr := range mask[:nptrWords] {
+			if isPtr {
+				gcdata[i/8] |= 1 << (i % 8)
+			}
+		}
+	}
+	return NewFakeType(size, uintptr(nptrWords)*ptrSize, gcdata)
+}
+
+// ptrMask returns which words of the first size bytes of an object of
+// type t are pointers. size may be larger than t.Size_, in which case the
+// rest of the object is treated as more elements of type t.
+func (t *FakeType) ptrMask(size uintptr) []bool {
+	mask := make([]bool, bitmath.AlignUp(size, ptrSize)/ptrSize)
+	for i := range mask {
+		off := uintptr(i) * ptrSize
+		if t.Size_ != 0 {
+			off %= t.Size_
+		}
+		if off < t.PtrBytes {
+			w := off / ptrSize
+			mask[i] = *addb(t.GCData, w/8)&(1<<(w%8)) != 0
+		}
+	}
+	return mask
+}
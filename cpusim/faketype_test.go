@@ -0,0 +1,213 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim_test
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim"
+)
+
+func TestFakeTypeBuilders(t *testing.T) {
+	// Sizes and offsets are in words.
+	const w = cpusim.PtrSize
+	ptr := cpusim.FakePointer()
+	pair := cpusim.FakeStruct(ptr, cpusim.FakeScalar(2*w), ptr)
+	big := cpusim.FakeArray(cpusim.FakeStruct(cpusim.FakeScalar(w), ptr), 40)
+
+	var bigOffs []uintptr
+	for i := range uintptr(40) {
+		bigOffs = append(bigOffs, i*2*w+w)
+	}
+
+	for _, test := range []struct {
+		name     string
+		typ      *cpusim.FakeType
+		size     uintptr
+		ptrBytes uintptr
+		offs     []uintptr
+	}{
+		{"Pointer", ptr, w, w, []uintptr{0}},
+		{"Scalar", cpusim.FakeScalar(3 * w), 3 * w, 0, nil},
+		{"Struct", pair, 4 * w, 4 * w, []uintptr{0, 3 * w}},
+		{"TrailingScalars", cpusim.FakeStruct(ptr, cpusim.FakeScalar(5*w)), 6 * w, w, []uintptr{0}},
+		{"NestedStruct", cpusim.FakeStruct(cpusim.FakeScalar(w), pair), 5 * w, 5 * w, []uintptr{w, 4 * w}},
+		{"Array", cpusim.FakeArray(pair, 3), 12 * w, 12 * w, []uintptr{0, 3 * w, 4 * w, 7 * w, 8 * w, 11 * w}},
+		{"ArrayOfScalars", cpusim.FakeArray(cpusim.FakeScalar(w), 100), 100 * w, 0, nil},
+		// More than 64 words, so iteration needs more than one bitmap word.
+		{"BigArray", big, 80 * w, 80 * w, bigOffs},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.typ.Size_ != test.size {
+				t.Errorf("size = %d, want %d", test.typ.Size_, test.size)
+			}
+			if test.typ.PtrBytes != test.ptrBytes {
+				t.Errorf("ptrBytes = %d, want %d", test.typ.PtrBytes, test.ptrBytes)
+			}
+			if got := cpusim.TypePointerOffsets(test.typ, test.typ.Size_); !slices.Equal(got, test.offs) {
+				t.Errorf("pointer offsets = %v, want %v", got, test.offs)
+			}
+		})
+	}
+}
+
+func TestFakeArrayMatchesTiling(t *testing.T) {
+	// An object made of n elements of a type must have the same pointers
+	// as a single element of the equivalent array type.
+	elem := cpusim.FakeStruct(cpusim.FakePointer(), cpusim.FakeScalar(cpusim.PtrSize), cpusim.FakePointer())
+	for _, n := range []uintptr{1, 2, 21, 22, 100} {
+		arr := cpusim.FakeArray(elem, n)
+		got := cpusim.TypePointerOffsets(elem, n*elem.Size_)
+		want := cpusim.TypePointerOffsets(arr, arr.Size_)
+		if !slices.Equal(got, want) {
+			t.Errorf("n=%d: tiled pointer offsets %v, array pointer offsets %v", n, got, want)
+		}
+	}
+}
+
+func TestFakeAligned(t *testing.T) {
+	ptr := cpusim.FakePointer()
+	aligned := cpusim.FakeAligned(ptr, 16)
+	for _, test := range []struct {
+		name  string
+		typ   *cpusim.FakeType
+		size  uintptr
+		align uintptr
+		offs  []uintptr
+	}{
+		{"Aligned", aligned, 16, 16, []uintptr{0}},
+		{"Unaligned", ptr, cpusim.PtrSize, 0, []uintptr{0}},
+		// The aligned field is padded to its alignment.
+		{"Struct", cpusim.FakeStruct(ptr, aligned), 32, 16, []uintptr{0, 16}},
+		{"Array", cpusim.FakeArray(aligned, 3), 48, 16, []uintptr{0, 16, 32}},
+		{"Reflect", cpusim.FakeFromReflect(reflect.TypeFor[[2]*int]()), 2 * cpusim.PtrSize, 0, []uintptr{0, cpusim.PtrSize}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.typ.Size_ != test.size {
+				t.Errorf("size = %d, want %d", test.typ.Size_, test.size)
+			}
+			if uintptr(test.typ.Align_) != test.align {
+				t.Errorf("align = %d, want %d", test.typ.Align_, test.align)
+			}
+			if got := cpusim.TypePointerOffsets(test.typ, test.typ.Size_); !slices.Equal(got, test.offs) {
+				t.Errorf("pointer offsets = %v, want %v", got, test.offs)
+			}
+		})
+	}
+}
+
+type reflectTestStruct struct {
+	a int64
+	p *int
+	s string
+	b [3]byte
+	x []int
+	i any
+	m map[int]int
+	f func()
+	c [2]struct {
+		n int32
+		p unsafe.Pointer
+	}
+}
+
+func TestFakeFromReflect(t *testing.T) {
+	const w = cpusim.PtrSize
+	var x reflectTestStruct
+	structOffs := []uintptr{
+		unsafe.Offsetof(x.p),
+		unsafe.Offsetof(x.s),
+		unsafe.Offsetof(x.x),
+		unsafe.Offsetof(x.i) + w,
+		unsafe.Offsetof(x.m),
+		unsafe.Offsetof(x.f),
+		unsafe.Offsetof(x.c) + unsafe.Offsetof(x.c[0].p),
+		unsafe.Offsetof(x.c) + unsafe.Sizeof(x.c[0]) + unsafe.Offsetof(x.c[0].p),
+	}
+	for _, test := range []struct {
+		typ  reflect.Type
+		offs []uintptr
+	}{
+		{reflect.TypeFor[int64](), nil},
+		{reflect.TypeFor[*int](), []uintptr{0}},
+		{reflect.TypeFor[string](), []uintptr{0}},
+		{reflect.TypeFor[[]int](), []uintptr{0}},
+		{reflect.TypeFor[any](), []uintptr{w}},
+		{reflect.TypeFor[error](), []uintptr{w}},
+		{reflect.TypeFor[[2]any](), []uintptr{w, 3 * w}},
+		{reflect.TypeFor[[4]int32](), nil},
+		{reflect.TypeFor[reflectTestStruct](), structOffs},
+	} {
+		t.Run(test.typ.String(), func(t *testing.T) {
+			typ := cpusim.FakeFromReflect(test.typ)
+			if typ.Size_ != test.typ.Size() {
+				t.Errorf("size = %d, want %d", typ.Size_, test.typ.Size())
+			}
+			if got := cpusim.TypePointerOffsets(typ, typ.Size_); !slices.Equal(got, test.offs) {
+				t.Errorf("pointer offsets = %v, want %v", got, test.offs)
+			}
+		})
+	}
+}
+
+type bigPtrArray [4096]struct {
+	p *int
+	n int
+}
+
+// lazyPtrArray is only used by TestFakeTypeOfLazyMask, so nothing scans
+// an object of this type before it does.
+type lazyPtrArray [4096]struct {
+	n int
+	p *int
+}
+
+func TestFakeTypeOf(t *testing.T) {
+	for _, typ := range []reflect.Type{
+		reflect.TypeFor[int64](),
+		reflect.TypeFor[*int](),
+		reflect.TypeFor[any](),
+		reflect.TypeFor[reflectTestStruct](),
+		reflect.TypeFor[[16]reflectTestStruct](),
+		reflect.TypeFor[escapeRequest](),
+		reflect.TypeFor[bigPtrArray](),
+	} {
+		t.Run(typ.String(), func(t *testing.T) {
+			ft := cpusim.FakeTypeOf(typ)
+			if !cpusim.RuntimeGCMaskBuilt(typ) {
+				t.Fatal("runtime has no pointer bitmap")
+			}
+			if ft.Size_ != typ.Size() {
+				t.Errorf("size = %d, want %d", ft.Size_, typ.Size())
+			}
+
+			// Make sure the check would notice a wrong layout.
+			if ft.PtrBytes == 0 || len(cpusim.TypePointerOffsets(ft, ft.Size_)) == int(ft.Size_/cpusim.PtrSize) {
+				return
+			}
+			wrong := cpusim.FakeArray(cpusim.FakePointer(), typ.Size()/cpusim.PtrSize)
+			if err := cpusim.CheckAgainstRuntime(wrong, typ); err == nil {
+				t.Error("all-pointer layout passed check against the runtime")
+			}
+		})
+	}
+}
+
+func TestFakeTypeOfLazyMask(t *testing.T) {
+	// The runtime builds the bitmaps of large types on demand, the first
+	// time it needs them, which FakeTypeOf has to make happen before it
+	// can check anything.
+	typ := reflect.TypeOf((*lazyPtrArray)(nil)).Elem()
+	if cpusim.RuntimeGCMaskBuilt(typ) {
+		t.Skip("runtime already has a pointer bitmap")
+	}
+	cpusim.FakeTypeOf(typ)
+	if !cpusim.RuntimeGCMaskBuilt(typ) {
+		t.Fatal("FakeTypeOf didn't get the runtime to build its pointer bitmap")
+	}
+}
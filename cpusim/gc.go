@@ -0,0 +1,153 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import "unsafe"
+
+// Collector is a toy mark-sweep garbage collector, for checking how much
+// GC work regions actually save.
+//
+// It collects a BaselineAllocator heap. Marking starts from a root set
+// and traces through both the heap and region memory, since heap objects
+// may be reachable only through region objects. Region memory isn't
+// scanned wholesale: only the region objects reachable from the roots
+// are, which are those that escaped and those still in use by a region
+// that hasn't been reset. That's the part of region memory a real GC
+// would have to scan, as in Scenario.ScannedRegionAllocBytesFrac.
+// Region memory is never swept, since regions free it themselves.
+//
+// Marking is done all at once, without a write barrier, so there must
+// be no allocation or pointer writes during Collect.
+type Collector struct {
+	heap *BaselineAllocator
+
+	// work is the mark work queue, and marked has the addresses of the
+	// region objects marked this cycle. Heap objects are marked in
+	// their spans.
+	work   []unsafe.Pointer
+	marked map[uintptr]struct{}
+}
+
+// GCStats describes the work done by one Collect.
+type GCStats struct {
+	HeapObjectsScanned    uint64
+	HeapBytesScanned      uint64
+	RegionObjectsScanned  uint64 // Region objects that haven't escaped.
+	RegionBytesScanned    uint64
+	EscapedObjectsScanned uint64 // Region objects that have escaped.
+	EscapedBytesScanned   uint64
+	PointersScanned       uint64 // Pointer slots examined, in all objects.
+	HeapObjectsFreed      uint64
+	HeapBytesFreed        uint64
+}
+
+// BytesScanned returns the total number of bytes scanned.
+func (s GCStats) BytesScanned() uint64 {
+	return s.HeapBytesScanned + s.RegionBytesScanned + s.EscapedBytesScanned
+}
+
+// NewCollector returns a Collector for heap.
+func NewCollector(heap *BaselineAllocator) *Collector {
+	return &Collector{heap: heap, marked: make(map[uintptr]struct{})}
+}
+
+// Collect marks everything reachable from roots, then sweeps the heap,
+// freeing every heap object that wasn't marked.
+func (c *Collector) Collect(roots []Pointer) GCStats {
+	var stats GCStats
+	for _, p := range roots {
+		c.greyObject(unsafe.Pointer(p))
+	}
+	for len(c.work) != 0 {
+		p := c.work[len(c.work)-1]
+		c.work = c.work[:len(c.work)-1]
+		c.scanObject(p, &stats)
+	}
+	clear(c.marked)
+	stats.HeapObjectsFreed, stats.HeapBytesFreed = c.heap.sweep()
+	return stats
+}
+
+// greyObject marks the object containing p, if it's in the heap or region
+// memory and isn't already marked, and queues it to be scanned.
+func (c *Collector) greyObject(p unsafe.Pointer) {
+	if p == nil {
+		return
+	}
+	if s := c.heap.spanOf(uintptr(p)); s != nil {
+		i := (uintptr(p) - s.base()) / s.elemsize
+		if i >= s.nelems || s.gcmarkBits[i/8]&(1<<(i%8)) != 0 {
+			return
+		}
+		s.gcmarkBits[i/8] |= 1 << (i % 8)
+		c.work = append(c.work, s.at(i*s.elemsize))
+		return
+	}
+	if isRegionMemory(uintptr(p)) {
+		addr, _, _ := regionObjectOf(p)
+		if _, ok := c.marked[uintptr(addr)]; ok {
+			return
+		}
+		c.marked[uintptr(addr)] = struct{}{}
+		c.work = append(c.work, addr)
+	}
+}
+
+// scanObject greys everything pointed to by the marked object at p.
+func (c *Collector) scanObject(p unsafe.Pointer, stats *GCStats) {
+	if s := c.heap.spanOf(uintptr(p)); s != nil {
+		stats.HeapObjectsScanned++
+		stats.HeapBytesScanned += uint64(s.elemsize)
+		switch {
+		case s.spanclass.noscan():
+		case s.spanclass.sizeclass() == 0:
+			if s.largeType != nil {
+				c.scanPointers(s.largeType, p, s.elemsize, stats)
+			}
+		case heapBitsInSpan(s.elemsize):
+			hb := s.heapBits()
+			for off := uintptr(0); off < s.elemsize; off += ptrSize {
+				w := (uintptr(p) - s.base() + off) / ptrSize
+				if hb[w/ptrBits]&(1<<(w%ptrBits)) != 0 {
+					stats.PointersScanned++
+					c.greyObject(*(*unsafe.Pointer)(unsafe.Add(p, off)))
+				}
+			}
+		default:
+			typ := *(**FakeType)(p)
+			c.scanPointers(typ, unsafe.Add(p, mallocHeaderSize), s.elemsize-mallocHeaderSize, stats)
+		}
+		return
+	}
+	addr, size, typ := regionObjectOf(p)
+	if isEscaped(addr) {
+		stats.EscapedObjectsScanned++
+		stats.EscapedBytesScanned += uint64(size)
+	} else {
+		stats.RegionObjectsScanned++
+		stats.RegionBytesScanned += uint64(size)
+	}
+	if typ.PtrBytes != 0 {
+		c.scanPointers(typ, addr, size, stats)
+	}
+}
+
+// scanPointers greys everything pointed to by the object of type typ at
+// obj with the given size.
+func (c *Collector) scanPointers(typ *FakeType, obj unsafe.Pointer, size uintptr, stats *GCStats) {
+	start := uintptr(obj)
+	limit := start + size
+	tp := typePointers{elem: start, addr: start, mask: readUintptr(typ.GCData), typ: typ}
+	for {
+		var addr uintptr
+		if tp, addr = tp.nextFast(); addr == 0 {
+			if tp, addr = tp.next(limit); addr == 0 {
+				break
+			}
+		}
+		stats.PointersScanned++
+		c.greyObject(*(*unsafe.Pointer)(unsafe.Add(obj, addr-start)))
+	}
+}
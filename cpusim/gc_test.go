@@ -0,0 +1,112 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim"
+)
+
+// node is the layout of gcNode objects: a pointer and a value.
+type node struct {
+	next *node
+	val  uintptr
+}
+
+var gcNode = cpusim.FakeStruct(cpusim.FakePointer(), cpusim.FakeScalar(cpusim.PtrSize))
+
+// makeList allocates a linked list of n gcNodes with the given values
+// from make, and returns its head.
+func makeList(make func(uintptr, *cpusim.FakeType) cpusim.Pointer, n int, val uintptr) *node {
+	var head *node
+	for range n {
+		x := (*node)(unsafe.Pointer(make(gcNode.Size_, gcNode)))
+		x.next = head
+		x.val = val
+		head = x
+	}
+	return head
+}
+
+func checkList(t *testing.T, name string, head *node, n int, val uintptr) {
+	t.Helper()
+	i := 0
+	for x := head; x != nil; x = x.next {
+		if x.val != val {
+			t.Errorf("%s: node %d has value %d, want %d", name, i, x.val, val)
+			return
+		}
+		i++
+	}
+	if i != n {
+		t.Errorf("%s: %d nodes, want %d", name, i, n)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	const n = 1000
+	heap := cpusim.NewBaselineAllocator()
+	a := cpusim.NewAllocator(nil)
+	c := cpusim.NewCollector(heap)
+
+	// A list that's live, one that's garbage, and one that's only
+	// reachable through a region object.
+	live := makeList(heap.Make, n, 1)
+	makeList(heap.Make, n, 2)
+	viaRegion := makeList(heap.Make, n, 3)
+	r := (*node)(unsafe.Pointer(a.Make(gcNode.Size_, gcNode)))
+	r.next = viaRegion
+
+	// A region list that has escaped, and large and header-carrying
+	// heap objects that point to heap lists.
+	escaped := makeList(a.Make, n, 4)
+	cpusim.MarkEscaped(cpusim.Pointer(unsafe.Pointer(escaped)))
+	big := cpusim.FakeArray(gcNode, 4096)
+	bigObj := (*node)(unsafe.Pointer(heap.Make(big.Size_, big)))
+	bigObj.next = makeList(heap.Make, n, 5)
+	mid := cpusim.FakeArray(gcNode, 64)
+	midObj := (*node)(unsafe.Pointer(heap.Make(mid.Size_, mid)))
+	midObj.next = makeList(heap.Make, n, 6)
+
+	roots := []cpusim.Pointer{
+		cpusim.Pointer(unsafe.Pointer(live)),
+		cpusim.Pointer(unsafe.Pointer(r)),
+		cpusim.Pointer(unsafe.Pointer(escaped)),
+		cpusim.Pointer(unsafe.Pointer(bigObj)),
+		cpusim.Pointer(unsafe.Pointer(midObj)),
+	}
+	s := c.Collect(roots)
+	if s.HeapObjectsFreed != n {
+		t.Errorf("freed %d heap objects, want %d", s.HeapObjectsFreed, n)
+	}
+	if want := uint64(4*n + 2); s.HeapObjectsScanned != want {
+		t.Errorf("scanned %d heap objects, want %d", s.HeapObjectsScanned, want)
+	}
+	if s.RegionObjectsScanned != 1 {
+		t.Errorf("scanned %d region objects, want 1", s.RegionObjectsScanned)
+	}
+	if s.EscapedObjectsScanned != n {
+		t.Errorf("scanned %d escaped objects, want %d", s.EscapedObjectsScanned, n)
+	}
+
+	// Reuse the freed memory and make sure the live lists survived.
+	makeList(heap.Make, 4*n, 7)
+	checkList(t, "live", live, n, 1)
+	checkList(t, "viaRegion", viaRegion, n, 3)
+	checkList(t, "escaped", escaped, n, 4)
+	checkList(t, "big", bigObj.next, n, 5)
+	checkList(t, "mid", midObj.next, n, 6)
+
+	// With no roots, everything in the heap is garbage.
+	s = c.Collect(nil)
+	if want := uint64(4*n + 2 + 4*n); s.HeapObjectsFreed != want {
+		t.Errorf("freed %d heap objects, want %d", s.HeapObjectsFreed, want)
+	}
+	if s.BytesScanned() != 0 {
+		t.Errorf("scanned %d bytes with no roots", s.BytesScanned())
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import (
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+// Block geometry.
+//
+// BlockSize and lineSize are chosen at build time, so that they stay
+// constants on the allocation and write barrier fast paths:
+//
+//	-tags cpusim_block16k, cpusim_block32k or cpusim_block64k
+//	-tags cpusim_line64 or cpusim_line256
+//
+// The defaults are 8 KiB blocks and 128-byte lines. Everything else is
+// derived from those two.
+const (
+	minAlign   = 8
+	BitmapSize = BlockSize / minAlign / 8
+
+	// linesPerBlock is the number of lines in a block.
+	linesPerBlock = BlockSize / lineSize
+
+	// lineMaskWords is the number of words in a LineMask.
+	lineMaskWords = (linesPerBlock + 63) / 64
+
+	// metaSize is the size of the block metadata at the start of each
+	// block.
+	metaSize = unsafe.Sizeof(BlockMeta{})
+
+	// headerWords is the number of bitmap words an object header takes
+	// up in front of each object.
+	headerWords = headerSize / minAlign
+
+	// maxSmallSize is the largest header-inclusive allocation that
+	// fits in an empty block. Anything larger gets a dedicated
+	// large object block.
+	maxSmallSize = BlockSize - metaSize - minAlign
+
+	// reservedLines is the number of lines at the start of each block
+	// that are entirely block metadata. The line after them may also
+	// start with metadata; refill skips over it.
+	reservedLines = metaSize / lineSize
+
+	// regionOffset is the offset of BlockMeta.Region in a block, for
+	// the write barrier.
+	regionOffset = unsafe.Offsetof(BlockMeta{}.Region)
+)
+
+// reservedLineMask has a bit set for each reserved line, and for each
+// bit of a LineMask past the end of the block, so that those are never
+// allocated.
+var reservedLineMask LineMask
+
+func init() {
+	if BlockSize&(BlockSize-1) != 0 || lineSize&(lineSize-1) != 0 {
+		panic("block and line sizes must be powers of two")
+	}
+	if lineSize/minAlign > 64 {
+		// The portable clearLineBits assumes that a bitmap word covers
+		// at least one whole line.
+		panic("line bitmaps must fit in one word")
+	}
+	if maxSmallSize <= lineSize {
+		panic("block metadata leaves no room for objects")
+	}
+	reservedLineMask.setRange(0, reservedLines)
+	reservedLineMask.setRange(linesPerBlock, lineMaskWords*64-linesPerBlock)
+}
+
+// Geometry describes the block geometry cpusim was built with, like
+// "8KiB/128B".
+func Geometry() string {
+	return fmt.Sprintf("%dKiB/%dB", BlockSize>>10, lineSize)
+}
+
+// LineMask is a bitmap with one bit per line in a block.
+type LineMask [lineMaskWords]uint64
+
+// Set sets the bit for line i.
+func (m *LineMask) Set(i uintptr) {
+	m[i/64] |= 1 << (i % 64)
+}
+
+// IsSet returns whether the bit for line i is set.
+func (m LineMask) IsSet(i uintptr) bool {
+	return m[i/64]&(1<<(i%64)) != 0
+}
+
+// IsZero returns whether no bits are set.
+func (m LineMask) IsZero() bool {
+	return m == LineMask{}
+}
+
+// Count returns the number of bits set.
+func (m LineMask) Count() int {
+	n := 0
+	for _, w := range m {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// setRange sets the bits for lines [i, i+n).
+func (m *LineMask) setRange(i, n uintptr) {
+	for n > 0 {
+		k, j := i/64, i%64
+		c := min(n, 64-j)
+		m[k] |= (^uint64(0) >> (64 - c)) << j
+		i += c
+		n -= c
+	}
+}
+
+// setAll sets every bit, including those past the end of the block.
+func (m *LineMask) setAll() {
+	for k := range m {
+		m[k] = ^uint64(0)
+	}
+}
+
+// or returns the union of m and o.
+func (m LineMask) or(o LineMask) LineMask {
+	for k := range m {
+		m[k] |= o[k]
+	}
+	return m
+}
+
+// andNot returns the bits of m that aren't set in o.
+func (m LineMask) andNot(o LineMask) LineMask {
+	for k := range m {
+		m[k] &^= o[k]
+	}
+	return m
+}
+
+// next returns the index of the first bit at or after i that is set, if
+// set is true, or clear otherwise. It returns lineMaskWords*64 if there
+// is no such bit.
+func (m *LineMask) next(i uintptr, set bool) uintptr {
+	for k := i / 64; k < lineMaskWords; k++ {
+		w := m[k]
+		if !set {
+			w = ^w
+		}
+		if k == i/64 {
+			w &= ^uint64(0) << (i % 64)
+		}
+		if w != 0 {
+			return k*64 + uintptr(bits.TrailingZeros64(w))
+		}
+	}
+	return lineMaskWords * 64
+}
+
+// runs calls f for each run of set bits in m, with the index of the run's
+// first bit and its length.
+func (m *LineMask) runs(f func(i, n uintptr)) {
+	for i := m.next(0, true); i < lineMaskWords*64; {
+		j := m.next(i, false)
+		f(i, j-i)
+		i = m.next(j, true)
+	}
+}
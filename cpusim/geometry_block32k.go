@@ -0,0 +1,9 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cpusim_block32k && !cpusim_block64k
+
+package cpusim
+
+const BlockSize = 32 << 10
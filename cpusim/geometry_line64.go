@@ -0,0 +1,9 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cpusim_line64 && !cpusim_line256
+
+package cpusim
+
+const lineSize = 64
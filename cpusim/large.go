@@ -0,0 +1,116 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import (
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// largeBlock describes a large object block: its metadata, at the start
+// of its first chunk, the start of the object's header, and the end of
+// the object.
+//
+// Chunks past the first one in a large object block are entirely object
+// memory and have no BlockMeta of their own, so MarkEscaped needs some
+// way to find the right metadata. largeBlockOf plays the same role as the
+// runtime's span lookup.
+type largeBlock struct {
+	meta         *BlockMeta
+	start, limit uintptr
+}
+
+// base returns the address of the large object block.
+func (lb largeBlock) base() uintptr {
+	return uintptr(unsafe.Pointer(lb.meta))
+}
+
+// makeLarge allocates an object too big to fit in a regular block.
+//
+// The object gets its own block of one or more contiguous BlockSize
+// chunks. The first chunk has the usual BlockMeta, followed by the
+// object's header and then the object itself, exactly as if it were the
+// first object allocated in an empty block, including any padding needed
+// to align it. The size field in the
+// object's header is zero, since large object sizes don't fit in it.
+// The real size is derived from the block's limit instead.
+func (a *Allocator) makeLarge(size uintptr, typ *FakeType) Pointer {
+	start := metaSize
+	if align := typ.align(); align > minAlign {
+		start = bitmath.AlignUp(start+headerSize, align) - headerSize
+	}
+	nblocks := bitmath.AlignUp(start+headerSize+size, BlockSize) / BlockSize
+
+	b := new(Block)
+	b.data = allocChunks(nblocks, true)
+	b.nblocks = nblocks
+	b.large = true
+	b.lineAlloc.setAll()
+	b.cursor = b.Base() + start
+	b.limit = b.cursor + headerSize + size
+
+	// Mark the start of the object.
+	b.setObjBit(start / minAlign)
+
+	addr := b.at(b.cursor)
+	setHeader(b.Meta(), b.cursor, makeObjHeader(typ, 0))
+
+	registerBlock(b, true)
+	setLargeBlock(largeBlock{b.Meta(), b.cursor, b.limit}, nblocks)
+	b.next = a.large
+	a.large = b
+	a.largeAllocs++
+	return Pointer(unsafe.Add(addr, headerSize))
+}
+
+// resetLarge drops all large object blocks that didn't escape, or all of
+// them if escaped objects have been evacuated.
+//
+// Escaped large objects otherwise stay put, since they're still live, and
+// remain owned by the allocator so that BlockOf and MarkEscaped continue
+// to work on them.
+func (a *Allocator) resetLarge(evacuated bool, stats *ResetStats) {
+	var kept *Block
+	for a.large != nil {
+		b := a.large
+		a.large = b.next
+		if !evacuated && !b.Meta().LineEscape.IsZero() {
+			b.next = kept
+			kept = b
+			stats.LargeBlocksPinned++
+			continue
+		}
+		b.next = nil
+		stats.LargeBlocksFreed++
+	}
+	a.large = kept
+}
+
+// markEscapedLarge marks the object in large object block lb as escaped.
+//
+// Only the first chunk of the block has escape bitmaps, so those cover
+// the object up to the end of the first chunk, and every line in the
+// first chunk is marked escaped.
+func markEscapedLarge(lb largeBlock) {
+	d := lb.meta
+	if !d.LineEscape.IsZero() {
+		// Already escaped.
+		return
+	}
+	start := lb.start
+	objIdx := (start - lb.base()) / minAlign
+	for i := objIdx; i < BlockSize/minAlign; i++ {
+		d.EscBits[i/64] |= uint64(1) << (i % 64)
+	}
+	d.LineEscape.setAll()
+
+	header, addr := headerOf(d, start)
+	typ := header.typ()
+	if typ.PtrBytes == 0 {
+		return
+	}
+	markEscapedPointers(d, typ, addr, lb.limit-addr)
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !cpusim_headerless
+
+package cpusim
+
+import (
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// The default object layout: every object is immediately preceded by its
+// objHeader, and ObjBits marks the start of the header. See
+// layout_headerless.go for the alternative.
+
+const headerSize = unsafe.Sizeof(objHeader(0))
+
+// lineHeaders is unused in this layout.
+type lineHeaders struct{}
+
+// tryAllocFast allocates size bytes, including the header, from the
+// current range of free lines, and returns the address of the object
+// after the header.
+func (b *Block) tryAllocFast(size uintptr, h objHeader) unsafe.Pointer {
+	c := b.cursor
+	n := c + size
+	if n < b.limit {
+		b.cursor = n
+		b.setObjBit((c - b.Base()) / minAlign)
+		*(*objHeader)(b.at(c)) = h
+		return b.at(c + headerSize)
+	}
+	return nil
+}
+
+// tryAllocAligned is like tryAlloc, but places the allocation so that the
+// object after its header is aligned to align.
+func (b *Block) tryAllocAligned(size, align uintptr, h objHeader) unsafe.Pointer {
+	for {
+		if c := bitmath.AlignUp(b.cursor+headerSize, align) - headerSize; c+size < b.limit {
+			b.cursor = c
+			return b.tryAllocFast(size, h)
+		}
+		if !b.refill() {
+			return nil
+		}
+	}
+}
+
+// headerOf returns the header of the object whose ObjBits bit is at
+// start, in the block with metadata d, along with the object's address.
+func headerOf(d *BlockMeta, start uintptr) (h objHeader, addr uintptr) {
+	return *(*objHeader)(d.at(start)), start + headerSize
+}
+
+// setHeader sets the header of a large object starting at start, in the
+// block with metadata d.
+func setHeader(d *BlockMeta, start uintptr, h objHeader) {
+	*(*objHeader)(d.at(start)) = h
+}
+
+// clearHeaders forgets the headers of objects in lines.
+func (d *BlockMeta) clearHeaders(lines LineMask) {}
@@ -0,0 +1,134 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cpusim_headerless
+
+package cpusim
+
+import (
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// The headerless object layout, selected with -tags cpusim_headerless.
+//
+// Each line has one objHeader in BlockMeta, claimed by the first object
+// that starts in the line. Later objects starting in the same line with
+// the same header need nothing else, so a run of objects of one type
+// and size has no per-object overhead. An object whose header doesn't
+// match its line's gets an inline header in front of it instead, like in
+// the default layout, and a bit in InlineBits says so.
+//
+// Objects with stricter alignment than minAlign never get inline
+// headers. If the line doesn't match, they move on to the next one.
+//
+// Either way, ObjBits marks where the object starts, which is its inline
+// header if it has one.
+//
+// The line headers aren't free: Lines and InlineBits add 640 bytes to
+// every BlockMeta with the default 8 KiB blocks and 128-byte lines, for
+// 912 bytes in all instead of 272. That's 7 reserved lines per block
+// instead of 2, or about 8% of each block, which must be weighed against
+// the 8 bytes saved per object. BenchmarkLayout reports it as
+// meta-bytes/obj.
+
+const headerSize = 0
+
+// inlineHeaderSize is the size of the header of objects that can't use
+// their line's.
+const inlineHeaderSize = unsafe.Sizeof(objHeader(0))
+
+type lineHeaders struct {
+	// Lines has the header of the objects starting in each line,
+	// unless they have their own.
+	Lines [linesPerBlock]objHeader
+
+	// InlineBits has a bit set for each object that has its own header,
+	// at the start of the header.
+	InlineBits [BitmapSize / 8]uint64
+}
+
+// tryAllocFast allocates size bytes, plus an inline header if needed,
+// from the current range of free lines, and returns the address of the
+// object.
+func (b *Block) tryAllocFast(size uintptr, h objHeader) unsafe.Pointer {
+	c := b.cursor
+	n := c + size
+	if n >= b.limit {
+		return nil
+	}
+	d := b.Meta()
+	l := (c - b.Base()) / lineSize
+	i := (c - b.Base()) / minAlign
+	if hs := &d.headers; hs.Lines[l] != h {
+		if d.lineHasObjects(l) {
+			// Objects of another type or size already start in this
+			// line, so this one needs its own header.
+			n += inlineHeaderSize
+			if n >= b.limit {
+				return nil
+			}
+			b.cursor = n
+			b.setObjBit(i)
+			hs.InlineBits[i/64] |= 1 << (i % 64)
+			*(*objHeader)(b.at(c)) = h
+			return b.at(c + inlineHeaderSize)
+		}
+		hs.Lines[l] = h
+	}
+	b.cursor = n
+	b.setObjBit(i)
+	return b.at(c)
+}
+
+// tryAllocAligned is like tryAlloc, but places the allocation so that the
+// object is aligned to align. It only ever uses line headers.
+func (b *Block) tryAllocAligned(size, align uintptr, h objHeader) unsafe.Pointer {
+	d := b.Meta()
+	for {
+		c := bitmath.AlignUp(b.cursor, align)
+		if c+size >= b.limit {
+			if !b.refill() {
+				return nil
+			}
+			continue
+		}
+		if l := (c - b.Base()) / lineSize; d.headers.Lines[l] != h && d.lineHasObjects(l) {
+			// Try the next line, which is suitably aligned too.
+			b.cursor = bitmath.AlignUp(c+1, lineSize)
+			continue
+		}
+		b.cursor = c
+		return b.tryAllocFast(size, h)
+	}
+}
+
+// lineHasObjects returns whether any object starts in line l.
+func (d *BlockMeta) lineHasObjects(l uintptr) bool {
+	const bitsPerLine = lineSize / minAlign
+	i := l * bitsPerLine
+	return d.ObjBits[i/64]>>(i%64)&(^uint64(0)>>(64-bitsPerLine)) != 0
+}
+
+// headerOf returns the header of the object whose ObjBits bit is at
+// start, in the block with metadata d, along with the object's address.
+func headerOf(d *BlockMeta, start uintptr) (h objHeader, addr uintptr) {
+	i := (start - uintptr(unsafe.Pointer(d))) / minAlign
+	if d.headers.InlineBits[i/64]&(1<<(i%64)) != 0 {
+		return *(*objHeader)(d.at(start)), start + inlineHeaderSize
+	}
+	return d.headers.Lines[i*minAlign/lineSize], start
+}
+
+// setHeader sets the header of a large object starting at start, in the
+// block with metadata d.
+func setHeader(d *BlockMeta, start uintptr, h objHeader) {
+	d.headers.Lines[(start-uintptr(unsafe.Pointer(d)))/lineSize] = h
+}
+
+// clearHeaders forgets the headers of objects in lines.
+func (d *BlockMeta) clearHeaders(lines LineMask) {
+	clearLineBits(&d.headers.InlineBits, lines)
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// Region memory.
+//
+// Blocks get their memory from region arenas: HeapArenaBytes-aligned
+// ranges of address space that hold nothing but blocks, and are marked in
+// IsRegionArena. Telling region memory apart from the rest of the heap is
+// then the same bitmap test that RegionWriteBarrierFastPath does, which
+// is what a real implementation would do too.
+//
+// Large object blocks get arenas of their own, marked in largeArenas, so
+// that regular blocks never need the chunk lookup in largeBlockOf.
+//
+// Region arenas are never released. When a block dies, a finalizer
+// queues its chunks on deadChunks, and they are put back on a free list
+// the next time a block needs memory. Only the Block keeps its memory
+// alive, not Pointers into it. The finalizer doesn't touch the
+// block's memory, since NewBlockFromExisting blocks may have been
+// allocated by someone else, and be gone by then.
+
+const (
+	// numArenas is the number of arenas in the address space.
+	numArenas = AddrSpace / HeapArenaBytes
+
+	// chunksPerArena is the number of BlockSize chunks in an arena.
+	chunksPerArena = HeapArenaBytes / BlockSize
+
+	// arenaL2Size is the number of arenas covered by each second-level
+	// table in largeChunks.
+	arenaL2Size = 1 << 12
+)
+
+// largeArenas has a bit set for each region arena that holds large
+// object blocks, like IsRegionArena.
+var largeArenas [numArenas / 64]uint64
+
+// largeChunks describes the large object block backing each chunk of
+// each large arena. It's a two-level table indexed by arena, like the
+// runtime's arena index, so it only takes up space for arenas in use.
+var largeChunks [numArenas / arenaL2Size]*[arenaL2Size]*[chunksPerArena]largeBlock
+
+// chunkHeap hands out runs of contiguous BlockSize chunks from region
+// arenas.
+type chunkHeap struct {
+	large bool                         // Mark arenas in largeArenas.
+	cur   unsafe.Pointer               // Unused chunks in the newest arenas,
+	left  uintptr                      // and how many bytes of them there are.
+	free  map[uintptr][]unsafe.Pointer // Free runs of chunks, by length.
+}
+
+var (
+	blockHeap = chunkHeap{}
+	largeHeap = chunkHeap{large: true}
+)
+
+var deadChunks struct {
+	sync.Mutex
+	pending atomic.Bool
+	runs    []deadRun
+}
+
+// deadRun is a run of chunks freed by a block's finalizer.
+type deadRun struct {
+	base  unsafe.Pointer
+	n     uintptr
+	large bool
+}
+
+// allocChunks returns zeroed memory for n contiguous BlockSize chunks in
+// region arenas. large selects arenas for large object blocks.
+func allocChunks(n uintptr, large bool) *[BlockSize]byte {
+	sweepDeadChunks()
+	h := &blockHeap
+	if large {
+		h = &largeHeap
+	}
+	if runs := h.free[n]; len(runs) != 0 {
+		base := runs[len(runs)-1]
+		h.free[n] = runs[:len(runs)-1]
+		memclrNoHeapPointers(base, n*BlockSize)
+		return (*[BlockSize]byte)(base)
+	}
+	if h.left < n*BlockSize {
+		// Keep whatever is left of the current arena for later.
+		if h.left != 0 {
+			h.freeRun(h.cur, h.left/BlockSize)
+		}
+		size := bitmath.AlignUp(n*BlockSize, HeapArenaBytes)
+		h.cur = reserveArenas(size / HeapArenaBytes)
+		h.left = size
+		for a := uintptr(h.cur); a < uintptr(h.cur)+size; a += HeapArenaBytes {
+			setArenaBit(&IsRegionArena, a)
+			if h.large {
+				setArenaBit(&largeArenas, a)
+			}
+		}
+	}
+	base := h.cur
+	h.cur = unsafe.Add(h.cur, n*BlockSize)
+	h.left -= n * BlockSize
+	return (*[BlockSize]byte)(base)
+}
+
+// freeRun makes the n chunks starting at base available for reuse.
+// Regular blocks only ever need one chunk, so their runs are split up.
+func (h *chunkHeap) freeRun(base unsafe.Pointer, n uintptr) {
+	if h.free == nil {
+		h.free = make(map[uintptr][]unsafe.Pointer)
+	}
+	if h.large {
+		h.free[n] = append(h.free[n], base)
+		return
+	}
+	for i := range n {
+		h.free[1] = append(h.free[1], unsafe.Add(base, i*BlockSize))
+	}
+}
+
+func setArenaBit(bitmap *[numArenas / 64]uint64, p uintptr) {
+	arena := p / HeapArenaBytes
+	bitmap[arena/64] |= uint64(1) << (arena % 64)
+}
+
+// registerBlock makes sure b's memory is recognized as region memory,
+// and arranges for it to be reused once b dies if it came from
+// allocChunks.
+func registerBlock(b *Block, owned bool) {
+	if !owned {
+		for a := b.Base(); a < b.Base()+b.nblocks*BlockSize; a += HeapArenaBytes {
+			setArenaBit(&IsRegionArena, a)
+		}
+		return
+	}
+	run := deadRun{unsafe.Pointer(b.data), b.nblocks, b.large}
+	runtime.SetFinalizer(b, func(*Block) {
+		deadChunks.Lock()
+		deadChunks.runs = append(deadChunks.runs, run)
+		deadChunks.pending.Store(true)
+		deadChunks.Unlock()
+	})
+}
+
+// setLargeBlock records lb as the large object block backing each of its
+// n chunks.
+func setLargeBlock(lb largeBlock, n uintptr) {
+	for c := lb.base(); c < lb.base()+n*BlockSize; c += BlockSize {
+		arena := c / HeapArenaBytes
+		l2 := largeChunks[arena/arenaL2Size]
+		if l2 == nil {
+			l2 = new([arenaL2Size]*[chunksPerArena]largeBlock)
+			largeChunks[arena/arenaL2Size] = l2
+		}
+		chunks := l2[arena%arenaL2Size]
+		if chunks == nil {
+			chunks = new([chunksPerArena]largeBlock)
+			l2[arena%arenaL2Size] = chunks
+		}
+		chunks[c%HeapArenaBytes/BlockSize] = lb
+	}
+}
+
+// largeBlockOf returns the large object block containing p, if any.
+func largeBlockOf(p uintptr) (largeBlock, bool) {
+	arena := p / HeapArenaBytes
+	if largeArenas[arena/64]&(uint64(1)<<(arena%64)) == 0 {
+		return largeBlock{}, false
+	}
+	return largeChunks[arena/arenaL2Size][arena%arenaL2Size][p%HeapArenaBytes/BlockSize], true
+}
+
+// isRegionMemory returns whether p points into a region arena.
+func isRegionMemory(p uintptr) bool {
+	arena := p / HeapArenaBytes
+	return IsRegionArena[arena/64]&(uint64(1)<<(arena%64)) != 0
+}
+
+func sweepDeadChunks() {
+	if !deadChunks.pending.Load() {
+		return
+	}
+	deadChunks.Lock()
+	for _, r := range deadChunks.runs {
+		if r.large {
+			largeHeap.freeRun(r.base, r.n)
+		} else {
+			blockHeap.freeRun(r.base, r.n)
+		}
+	}
+	deadChunks.runs = deadChunks.runs[:0]
+	deadChunks.pending.Store(false)
+	deadChunks.Unlock()
+}
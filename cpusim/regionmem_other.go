@@ -0,0 +1,29 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package cpusim
+
+import (
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// arenaMem keeps the memory backing region arenas alive.
+var arenaMem [][]byte
+
+// reserveArenas allocates n contiguous arenas of zeroed memory and
+// returns the first one.
+//
+// Without mmap, the memory comes from the Go heap. An allocation one
+// arena larger than needed always covers n whole aligned arenas, which
+// then hold nothing else.
+func reserveArenas(n uintptr) unsafe.Pointer {
+	mem := make([]byte, (n+1)*HeapArenaBytes)
+	arenaMem = append(arenaMem, mem)
+	addr := uintptr(unsafe.Pointer(&mem[0]))
+	return unsafe.Pointer(&mem[bitmath.AlignUp(addr, HeapArenaBytes)-addr])
+}
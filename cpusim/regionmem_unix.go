@@ -0,0 +1,28 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package cpusim
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// reserveArenas maps n contiguous arenas of zeroed memory outside of the
+// Go heap and returns the first one.
+func reserveArenas(n uintptr) unsafe.Pointer {
+	// Map an extra arena's worth, so that there's room to align. The
+	// ends are never touched, so they only cost address space.
+	size := (n + 1) * HeapArenaBytes
+	mem, err := syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		panic("cpusim: mapping region arenas: " + err.Error())
+	}
+	addr := uintptr(unsafe.Pointer(&mem[0]))
+	return unsafe.Pointer(&mem[bitmath.AlignUp(addr, HeapArenaBytes)-addr])
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import (
+	"iter"
+	"math/bits"
+)
+
+// Stats is a snapshot of an Allocator's memory, along with counters
+// describing how the allocator got there.
+type Stats struct {
+	Blocks      int // Regular blocks owned by the allocator, including free ones.
+	FreeBlocks  int // Regular blocks on the free list.
+	LargeBlocks int // Large object blocks.
+
+	Lines        int // Allocatable lines in regular blocks.
+	LinesUsed    int // Lines claimed for allocation, including escaped lines.
+	LinesEscaped int // Lines pinned by escaped objects.
+
+	Objects          int    // Objects in all blocks.
+	ObjectBytes      uint64 // Bytes occupied by objects in regular blocks, including headers.
+	LargeObjectBytes uint64 // Bytes occupied by large objects, including headers.
+	EscapedObjects   int    // Escaped objects in all blocks.
+	EscapedBytes     uint64 // Bytes occupied by escaped objects, including headers.
+
+	Refills        uint64 // Times a block found a new range of free lines.
+	OverflowAllocs uint64 // Allocations satisfied by an overflow block.
+	OverflowBlocks uint64 // Overflow blocks created.
+	LargeAllocs    uint64 // Large object allocations.
+}
+
+// Utilization returns the fraction of claimed line memory in regular
+// blocks that is occupied by objects.
+func (s Stats) Utilization() float64 {
+	if s.LinesUsed == 0 {
+		return 0
+	}
+	return float64(s.ObjectBytes) / float64(s.LinesUsed*lineSize)
+}
+
+// Stats returns a snapshot of the allocator's state. It walks every
+// block, so it is not cheap.
+func (a *Allocator) Stats() Stats {
+	s := Stats{
+		FreeBlocks:     len(a.existing),
+		OverflowAllocs: a.overflowAllocs,
+		OverflowBlocks: a.overflowBlocks,
+		LargeAllocs:    a.largeAllocs,
+	}
+	for b := range a.blocks() {
+		if b.large {
+			s.LargeBlocks++
+		} else {
+			s.Blocks++
+			s.Lines += int(linesPerBlock - reservedLines)
+			s.LinesUsed += b.lineAlloc.andNot(reservedLineMask).Count()
+			s.LinesEscaped += b.Meta().LineEscape.Count()
+		}
+		s.Refills += b.refills
+		for obj := range b.Objects() {
+			s.Objects++
+			if b.large {
+				s.LargeObjectBytes += uint64(obj.fullSize())
+			} else {
+				s.ObjectBytes += uint64(obj.fullSize())
+			}
+			if obj.Escaped {
+				s.EscapedObjects++
+				s.EscapedBytes += uint64(obj.fullSize())
+			}
+		}
+	}
+	return s
+}
+
+// blocks iterates over every block owned by the allocator.
+func (a *Allocator) blocks() iter.Seq[*Block] {
+	return func(yield func(*Block) bool) {
+		for _, b := range []*Block{a.main, a.overflow} {
+			if b != nil && !yield(b) {
+				return
+			}
+		}
+		for _, list := range []*Block{a.full, a.large} {
+			for b := list; b != nil; b = b.next {
+				if !yield(b) {
+					return
+				}
+			}
+		}
+		for _, b := range a.existing {
+			if !yield(b) {
+				return
+			}
+		}
+	}
+}
+
+// LineState describes how a line in a block is being used.
+type LineState uint8
+
+const (
+	LineFree     LineState = iota // Available for allocation.
+	LineReserved                  // Holds block metadata.
+	LineUsed                      // Claimed for allocation.
+	LineEscaped                   // Pinned by an escaped object.
+)
+
+func (s LineState) String() string {
+	switch s {
+	case LineFree:
+		return "free"
+	case LineReserved:
+		return "reserved"
+	case LineUsed:
+		return "used"
+	case LineEscaped:
+		return "escaped"
+	}
+	return "unknown"
+}
+
+// Lines returns the state of each line in the block.
+//
+// For large object blocks, this only describes the first BlockSize chunk.
+func (b *Block) Lines() [linesPerBlock]LineState {
+	var lines [linesPerBlock]LineState
+	esc := &b.Meta().LineEscape
+	for i := range uintptr(len(lines)) {
+		switch {
+		case reservedLineMask.IsSet(i):
+			lines[i] = LineReserved
+		case esc.IsSet(i):
+			lines[i] = LineEscaped
+		case b.lineAlloc.IsSet(i):
+			lines[i] = LineUsed
+		}
+	}
+	return lines
+}
+
+// Object describes an object in a block.
+type Object struct {
+	Addr    Pointer // Start of the object, just past its header.
+	Size    uintptr // Size of the object, excluding its header.
+	Type    *FakeType
+	Escaped bool
+
+	start uintptr // Start of the object's header, or Addr if it has none.
+}
+
+// fullSize returns the number of bytes the object occupies, including its
+// header.
+func (obj Object) fullSize() uintptr {
+	return uintptr(obj.Addr) - obj.start + obj.Size
+}
+
+// Objects iterates over every object in the block, in address order.
+//
+// Objects are found via ObjBits, so after a Reset this includes only
+// escaped objects in pinned lines.
+func (b *Block) Objects() iter.Seq[Object] {
+	return func(yield func(Object) bool) {
+		d := b.Meta()
+		for k, w := range d.ObjBits {
+			for w != 0 {
+				i := uintptr(k*64 + bits.TrailingZeros64(w))
+				w &= w - 1
+
+				addr := b.Base() + i*minAlign
+				header, objAddr := headerOf(d, addr)
+				obj := Object{
+					Addr:    Pointer(b.at(objAddr)),
+					Size:    header.size(),
+					Type:    header.typ(),
+					Escaped: d.EscBits[i/64]&(uint64(1)<<(i%64)) != 0,
+					start:   addr,
+				}
+				if b.large {
+					obj.Size = b.limit - objAddr
+				}
+				if !yield(obj) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// EscapedObjects iterates over every escaped object in the block, in
+// address order.
+func (b *Block) EscapedObjects() iter.Seq[Object] {
+	return func(yield func(Object) bool) {
+		for obj := range b.Objects() {
+			if obj.Escaped && !yield(obj) {
+				return
+			}
+		}
+	}
+}
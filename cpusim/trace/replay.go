@@ -0,0 +1,255 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim"
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// Stats summarizes a replayed trace.
+type Stats struct {
+	Allocs           uint64
+	AllocBytes       uint64
+	RegionAllocs     uint64
+	RegionAllocBytes uint64
+
+	// Fade* describe region allocations that escaped by the end of
+	// their region. FadePointers is the number of pointer words in
+	// those objects.
+	FadeAllocs     uint64
+	FadeAllocBytes uint64
+	FadePointers   uint64
+
+	PointerWrites uint64
+	Writes        [cpusim.NumWriteKinds]uint64 // PointerWrites by kind.
+	Escapes       uint64                       // Escape events.
+	Regions       uint64                       // Completed regions.
+}
+
+// ScenarioParams are the parameters of a region-eval scenario that can be
+// measured by replaying a trace. Fields have the same names and meanings
+// as the corresponding fields of region-eval's Scenario.
+type ScenarioParams struct {
+	RegionAllocBytesFrac     float64 // Fraction of bytes that are allocated in a region.
+	RegionAllocsFrac         float64 // Fraction of objects that are allocated in a region.
+	FadeAllocBytesFrac       float64 // Fraction of region-allocated bytes that fade.
+	FadeAllocsFrac           float64 // Fraction of region-allocated objects that fade.
+	FadeAllocsPointerDensity float64 // Average pointer density of region-allocated objects that fade.
+}
+
+// Scenario summarizes the replay as scenario parameters.
+//
+// An object fades if it is found to be escaped, via its escape bits, at
+// the end of the region it was allocated in. Pointer density is pointers
+// per byte, as derived from each object's type.
+func (s Stats) Scenario() ScenarioParams {
+	frac := func(n, d uint64) float64 {
+		if d == 0 {
+			return 0
+		}
+		return float64(n) / float64(d)
+	}
+	return ScenarioParams{
+		RegionAllocBytesFrac:     frac(s.RegionAllocBytes, s.AllocBytes),
+		RegionAllocsFrac:         frac(s.RegionAllocs, s.Allocs),
+		FadeAllocBytesFrac:       frac(s.FadeAllocBytes, s.RegionAllocBytes),
+		FadeAllocsFrac:           frac(s.FadeAllocs, s.RegionAllocs),
+		FadeAllocsPointerDensity: frac(s.FadePointers, s.FadeAllocBytes),
+	}
+}
+
+// Replayer drives a cpusim.Allocator from a trace.
+//
+// Region allocations are made with Allocator.Make, and regular heap
+// allocations come from the Go heap. Every write goes through
+// cpusim.WritePointer, and escape events call cpusim.MarkEscaped. At the
+// end of each region, objects that didn't escape are freed and the
+// allocator is reset. Everything else is forgotten when the trace frees
+// it, so that long traces don't accumulate dead objects.
+type Replayer struct {
+	Stats
+
+	a        *cpusim.Allocator
+	types    map[uint64]*replayType
+	objs     map[uint64]*replayObj
+	inRegion bool
+
+	// regionObjs are the objects allocated in the current region,
+	// including any that have been freed since.
+	regionObjs []*replayObj
+}
+
+type replayType struct {
+	typ    *cpusim.FakeType
+	gcdata []byte
+
+	// ptrWords is the number of pointer words per element.
+	ptrWords uint64
+}
+
+type replayObj struct {
+	id     uint64
+	ptr    unsafe.Pointer
+	size   uint64
+	typ    *replayType
+	region bool
+}
+
+// NewReplayer creates a new Replayer that allocates from a.
+func NewReplayer(a *cpusim.Allocator) *Replayer {
+	return &Replayer{
+		a:     a,
+		types: make(map[uint64]*replayType),
+		objs:  make(map[uint64]*replayObj),
+	}
+}
+
+// Replay applies every event in the trace read by r.
+func (r *Replayer) Replay(tr *Reader) error {
+	for {
+		ev, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := r.Apply(ev); err != nil {
+			return fmt.Errorf("line %d: %v", tr.line, err)
+		}
+	}
+}
+
+// Apply applies a single event.
+func (r *Replayer) Apply(ev Event) error {
+	switch ev.Kind {
+	case KindType:
+		if _, ok := r.types[ev.ID]; ok {
+			return fmt.Errorf("duplicate type %d", ev.ID)
+		}
+		if ev.PtrBytes > ev.Size || uint64(len(ev.GCData))*8*cpusim.PtrSize < ev.PtrBytes {
+			return fmt.Errorf("type %d: bad pointer bytes %d for size %d and %d bytes of gcdata", ev.ID, ev.PtrBytes, ev.Size, len(ev.GCData))
+		}
+		// NewFakeType requires gcdata to be a multiple of the pointer
+		// size, since it reads it a word at a time.
+		gcdata := make([]byte, bitmath.AlignUp(uintptr(len(ev.GCData)), cpusim.PtrSize))
+		copy(gcdata, ev.GCData)
+		var ptrWords uint64
+		for i := uint64(0); i < ev.PtrBytes/cpusim.PtrSize; i++ {
+			ptrWords += uint64(gcdata[i/8]>>(i%8)) & 1
+		}
+		r.types[ev.ID] = &replayType{
+			typ:      cpusim.NewFakeType(uintptr(ev.Size), uintptr(ev.PtrBytes), gcdata),
+			gcdata:   gcdata,
+			ptrWords: ptrWords,
+		}
+	case KindAlloc:
+		if _, ok := r.objs[ev.ID]; ok {
+			return fmt.Errorf("duplicate object %d", ev.ID)
+		}
+		typ, ok := r.types[ev.Type]
+		if !ok {
+			return fmt.Errorf("object %d: unknown type %d", ev.ID, ev.Type)
+		}
+		if ev.Size == 0 || typ.typ.Size_ == 0 || ev.Size%uint64(typ.typ.Size_) != 0 {
+			return fmt.Errorf("object %d: size %d is not a multiple of type %d's size %d", ev.ID, ev.Size, ev.Type, typ.typ.Size_)
+		}
+		obj := &replayObj{id: ev.ID, size: ev.Size, typ: typ, region: r.inRegion}
+		if r.inRegion {
+			obj.ptr = unsafe.Pointer(r.a.Make(uintptr(ev.Size), typ.typ))
+			r.regionObjs = append(r.regionObjs, obj)
+			r.RegionAllocs++
+			r.RegionAllocBytes += ev.Size
+		} else {
+			// The Go GC doesn't need to know about pointers in here,
+			// since they all point into blocks owned by the allocator.
+			obj.ptr = unsafe.Pointer(&make([]uintptr, (ev.Size+cpusim.PtrSize-1)/cpusim.PtrSize)[0])
+		}
+		r.objs[ev.ID] = obj
+		r.Allocs++
+		r.AllocBytes += ev.Size
+	case KindWrite:
+		obj, ok := r.objs[ev.ID]
+		if !ok {
+			return fmt.Errorf("write to unknown or freed object %d", ev.ID)
+		}
+		if ev.Offset%cpusim.PtrSize != 0 || ev.Offset+cpusim.PtrSize > obj.size || !obj.typ.isPointer(ev.Offset) {
+			return fmt.Errorf("write to object %d at offset %d, which is not a pointer word", ev.ID, ev.Offset)
+		}
+		var ptr unsafe.Pointer
+		if ev.Target != 0 {
+			target, ok := r.objs[ev.Target]
+			if !ok {
+				return fmt.Errorf("write of pointer to unknown or freed object %d", ev.Target)
+			}
+			ptr = target.ptr
+		}
+		k := cpusim.WritePointer(unsafe.Add(obj.ptr, ev.Offset), ptr)
+		r.PointerWrites++
+		r.Writes[k]++
+	case KindEscape:
+		obj, ok := r.objs[ev.ID]
+		if !ok {
+			return fmt.Errorf("escape of unknown or freed object %d", ev.ID)
+		}
+		if obj.region {
+			cpusim.MarkEscaped(cpusim.Pointer(obj.ptr))
+		}
+		r.Escapes++
+	case KindFree:
+		if _, ok := r.objs[ev.ID]; !ok {
+			return fmt.Errorf("free of unknown or freed object %d", ev.ID)
+		}
+		delete(r.objs, ev.ID)
+	case KindBegin:
+		if r.inRegion {
+			return fmt.Errorf("nested region")
+		}
+		r.inRegion = true
+	case KindEnd:
+		if !r.inRegion {
+			return fmt.Errorf("end of region outside of a region")
+		}
+		r.endRegion()
+	default:
+		return fmt.Errorf("unknown event kind %v", ev.Kind)
+	}
+	return nil
+}
+
+// endRegion frees every object allocated in the current region that
+// didn't escape, and resets the allocator.
+func (r *Replayer) endRegion() {
+	for _, obj := range r.regionObjs {
+		if !cpusim.IsEscaped(cpusim.Pointer(obj.ptr)) {
+			delete(r.objs, obj.id)
+			continue
+		}
+		r.FadeAllocs++
+		r.FadeAllocBytes += obj.size
+		r.FadePointers += obj.size / uint64(obj.typ.typ.Size_) * obj.typ.ptrWords
+	}
+	clear(r.regionObjs)
+	r.regionObjs = r.regionObjs[:0]
+	r.a.Reset()
+	r.inRegion = false
+	r.Regions++
+}
+
+// isPointer returns whether the word at offset in an object of this type
+// is a pointer.
+func (t *replayType) isPointer(offset uint64) bool {
+	off := offset % uint64(t.typ.Size_)
+	if off >= uint64(t.typ.PtrBytes) {
+		return false
+	}
+	i := off / cpusim.PtrSize
+	return t.gcdata[i/8]&(1<<(i%8)) != 0
+}
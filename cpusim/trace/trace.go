@@ -0,0 +1,260 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package trace defines a format for allocation traces, and replays them
+// through cpusim.
+//
+// A trace is a text file that starts with the line "region-trace v1",
+// followed by one event per line:
+//
+//	type <type> <size> <ptrbytes> <gcdata>
+//	alloc <obj> <type> <size>
+//	write <obj> <offset> <target>
+//	escape <obj>
+//	free <obj>
+//	begin
+//	end
+//
+// Types and objects are identified by IDs, which are assigned in order
+// starting from 1. A type's gcdata is its pointer bitmap in hex, or "-" if
+// it has no pointers. A write stores a pointer to target into the pointer
+// word at offset bytes into obj, where target 0 means nil. Words are
+// cpusim.PtrSize bytes, so a trace can only be replayed on a platform with
+// the same pointer size as the one it was captured on. An escape
+// means a pointer to obj was stored somewhere the trace doesn't track,
+// like a global or a goroutine's stack. A free means obj is dead and will
+// not be mentioned again; it's optional for region objects that don't
+// escape, which die with their region. Allocations between begin and end
+// are region allocations, and everything else is a regular heap
+// allocation. Regions do not nest.
+//
+// Writer is the capture side, and is meant to be driven by instrumented
+// programs. Replayer is the other side, and drives cpusim from a trace.
+package trace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const header = "region-trace v1"
+
+// Kind is the kind of a trace event.
+type Kind uint8
+
+const (
+	KindType Kind = iota + 1
+	KindAlloc
+	KindWrite
+	KindEscape
+	KindFree
+	KindBegin
+	KindEnd
+)
+
+var kindNames = [...]string{
+	KindType:   "type",
+	KindAlloc:  "alloc",
+	KindWrite:  "write",
+	KindEscape: "escape",
+	KindFree:   "free",
+	KindBegin:  "begin",
+	KindEnd:    "end",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) && kindNames[k] != "" {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", k)
+}
+
+// Event is a single trace event. Which fields are meaningful depends on
+// Kind.
+type Event struct {
+	Kind Kind
+
+	ID       uint64 // Type ID for KindType, object ID for KindAlloc, KindWrite, KindEscape and KindFree.
+	Type     uint64 // Type ID for KindAlloc.
+	Size     uint64 // For KindType and KindAlloc.
+	PtrBytes uint64 // For KindType.
+	GCData   []byte // For KindType.
+	Offset   uint64 // For KindWrite.
+	Target   uint64 // For KindWrite. Zero means nil.
+}
+
+// Writer writes a trace.
+type Writer struct {
+	w        *bufio.Writer
+	nextType uint64
+	nextObj  uint64
+	err      error
+}
+
+// NewWriter creates a new Writer that writes a trace to w.
+func NewWriter(w io.Writer) *Writer {
+	tw := &Writer{w: bufio.NewWriter(w), nextType: 1, nextObj: 1}
+	tw.printf("%s\n", header)
+	return tw
+}
+
+// Type records a new type and returns its ID.
+func (w *Writer) Type(size, ptrBytes uintptr, gcdata []byte) uint64 {
+	id := w.nextType
+	w.nextType++
+	gcd := "-"
+	if len(gcdata) != 0 {
+		gcd = hex.EncodeToString(gcdata)
+	}
+	w.printf("type %d %d %d %s\n", id, size, ptrBytes, gcd)
+	return id
+}
+
+// Alloc records a new allocation of the given type and size, and returns
+// the new object's ID. size may be a multiple of the type's size.
+func (w *Writer) Alloc(typ uint64, size uintptr) uint64 {
+	id := w.nextObj
+	w.nextObj++
+	w.printf("alloc %d %d %d\n", id, typ, size)
+	return id
+}
+
+// Write records a write of a pointer to target into obj at the given
+// offset. target may be 0, for a nil pointer.
+func (w *Writer) Write(obj uint64, offset uintptr, target uint64) {
+	w.printf("write %d %d %d\n", obj, offset, target)
+}
+
+// Escape records that a pointer to obj was stored somewhere untracked.
+func (w *Writer) Escape(obj uint64) {
+	w.printf("escape %d\n", obj)
+}
+
+// Free records that obj is dead.
+func (w *Writer) Free(obj uint64) {
+	w.printf("free %d\n", obj)
+}
+
+// Begin records the start of a region.
+func (w *Writer) Begin() {
+	w.printf("begin\n")
+}
+
+// End records the end of a region.
+func (w *Writer) End() {
+	w.printf("end\n")
+}
+
+// Flush writes any buffered data, and returns the first error encountered
+// while writing the trace.
+func (w *Writer) Flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func (w *Writer) printf(format string, args ...any) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+// Reader reads a trace.
+type Reader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+// NewReader creates a new Reader for the trace in r.
+func NewReader(r io.Reader) (*Reader, error) {
+	tr := &Reader{s: bufio.NewScanner(r)}
+	if !tr.s.Scan() {
+		if err := tr.s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("empty trace")
+	}
+	tr.line++
+	if got := tr.s.Text(); got != header {
+		return nil, fmt.Errorf("bad trace header %q", got)
+	}
+	return tr, nil
+}
+
+// Next returns the next event in the trace, or io.EOF if there are none
+// left.
+func (r *Reader) Next() (Event, error) {
+	for r.s.Scan() {
+		r.line++
+		fields := strings.Fields(r.s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		ev, err := parseEvent(fields)
+		if err != nil {
+			return Event{}, fmt.Errorf("line %d: %v", r.line, err)
+		}
+		return ev, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+func parseEvent(fields []string) (Event, error) {
+	var ev Event
+	var args []*uint64
+	switch fields[0] {
+	case "type":
+		if len(fields) != 5 {
+			return ev, fmt.Errorf("expected 4 arguments for type")
+		}
+		ev.Kind = KindType
+		args = []*uint64{&ev.ID, &ev.Size, &ev.PtrBytes}
+		if gcd := fields[4]; gcd != "-" {
+			var err error
+			ev.GCData, err = hex.DecodeString(gcd)
+			if err != nil {
+				return ev, fmt.Errorf("bad gcdata: %v", err)
+			}
+		}
+		fields = fields[:4]
+	case "alloc":
+		ev.Kind = KindAlloc
+		args = []*uint64{&ev.ID, &ev.Type, &ev.Size}
+	case "write":
+		ev.Kind = KindWrite
+		args = []*uint64{&ev.ID, &ev.Offset, &ev.Target}
+	case "escape":
+		ev.Kind = KindEscape
+		args = []*uint64{&ev.ID}
+	case "free":
+		ev.Kind = KindFree
+		args = []*uint64{&ev.ID}
+	case "begin":
+		ev.Kind = KindBegin
+	case "end":
+		ev.Kind = KindEnd
+	default:
+		return ev, fmt.Errorf("unknown event %q", fields[0])
+	}
+	if len(fields)-1 != len(args) {
+		return ev, fmt.Errorf("expected %d arguments for %s", len(args), fields[0])
+	}
+	for i, arg := range args {
+		v, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return ev, fmt.Errorf("bad argument %q for %s", fields[i+1], fields[0])
+		}
+		*arg = v
+	}
+	return ev, nil
+}
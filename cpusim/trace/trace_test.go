@@ -0,0 +1,160 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trace_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mknyszek/region-eval/cpusim"
+	"github.com/mknyszek/region-eval/cpusim/trace"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := trace.NewWriter(&buf)
+	node := w.Type(16, 8, []byte{0x01})
+	leaf := w.Type(32, 0, nil)
+	w.Begin()
+	a := w.Alloc(node, 16)
+	b := w.Alloc(leaf, 64)
+	w.Write(a, 0, b)
+	w.Write(a, 0, 0)
+	w.Escape(a)
+	w.End()
+	w.Free(a)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []trace.Event{
+		{Kind: trace.KindType, ID: node, Size: 16, PtrBytes: 8, GCData: []byte{0x01}},
+		{Kind: trace.KindType, ID: leaf, Size: 32},
+		{Kind: trace.KindBegin},
+		{Kind: trace.KindAlloc, ID: a, Type: node, Size: 16},
+		{Kind: trace.KindAlloc, ID: b, Type: leaf, Size: 64},
+		{Kind: trace.KindWrite, ID: a, Offset: 0, Target: b},
+		{Kind: trace.KindWrite, ID: a, Offset: 0, Target: 0},
+		{Kind: trace.KindEscape, ID: a},
+		{Kind: trace.KindEnd},
+		{Kind: trace.KindFree, ID: a},
+	}
+	r, err := trace.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []trace.Event
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ev)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+const testTrace = `region-trace v1
+type 1 16 8 01
+type 2 24 0 -
+alloc 1 1 16
+begin
+alloc 2 1 16
+alloc 3 1 16
+alloc 4 2 48
+write 2 0 3
+write 3 0 4
+alloc 5 1 16
+write 1 0 3
+end
+begin
+alloc 6 1 16
+write 6 0 3
+escape 6
+end
+`
+
+func TestReplay(t *testing.T) {
+	tr, err := trace.NewReader(strings.NewReader(testTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := cpusim.NewAllocator(nil)
+	rp := trace.NewReplayer(a)
+	if err := rp.Replay(tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Object 1 is a heap object, so the write of 3 into it makes 3 and
+	// 4 fade. It's also the only write into the heap. Object 6 escapes explicitly.
+	want := trace.Stats{
+		Allocs:           6,
+		AllocBytes:       16*5 + 48,
+		RegionAllocs:     5,
+		RegionAllocBytes: 16*4 + 48,
+		FadeAllocs:       3,
+		FadeAllocBytes:   16*2 + 48,
+		FadePointers:     2,
+		PointerWrites:    4,
+		Writes:           [cpusim.NumWriteKinds]uint64{cpusim.WriteSrcRegion: 1, cpusim.WriteBoth: 3},
+		Escapes:          1,
+		Regions:          2,
+	}
+	if rp.Stats != want {
+		t.Errorf("got stats %+v, want %+v", rp.Stats, want)
+	}
+
+	wantScenario := trace.ScenarioParams{
+		RegionAllocBytesFrac:     112.0 / 128.0,
+		RegionAllocsFrac:         5.0 / 6.0,
+		FadeAllocBytesFrac:       80.0 / 112.0,
+		FadeAllocsFrac:           3.0 / 5.0,
+		FadeAllocsPointerDensity: 2.0 / 80.0,
+	}
+	if got := rp.Scenario(); got != wantScenario {
+		t.Errorf("got scenario %+v, want %+v", got, wantScenario)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, trace string
+	}{
+		{"BadHeader", "not a trace\n"},
+		{"UnknownEvent", "region-trace v1\nfoo 1\n"},
+		{"BadArgs", "region-trace v1\nalloc 1 x 16\n"},
+		{"UnknownType", "region-trace v1\nalloc 1 1 16\n"},
+		{"BadSize", "region-trace v1\ntype 1 16 0 -\nalloc 1 1 24\n"},
+		{"NonPointerWrite", "region-trace v1\ntype 1 16 8 01\nalloc 1 1 16\nwrite 1 8 0\n"},
+		{"UseAfterFree", "region-trace v1\ntype 1 16 8 01\nbegin\nalloc 1 1 16\nend\nescape 1\n"},
+		{"HeapUseAfterFree", "region-trace v1\ntype 1 16 8 01\nalloc 1 1 16\nfree 1\nwrite 1 0 0\n"},
+		{"EscapedUseAfterFree", "region-trace v1\ntype 1 16 8 01\nbegin\nalloc 1 1 16\nescape 1\nend\nfree 1\nescape 1\n"},
+		{"DoubleFree", "region-trace v1\ntype 1 16 8 01\nalloc 1 1 16\nfree 1\nfree 1\n"},
+		{"NestedRegion", "region-trace v1\nbegin\nbegin\n"},
+		{"StrayEnd", "region-trace v1\nend\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr, err := trace.NewReader(strings.NewReader(tc.trace))
+			if err == nil {
+				err = trace.NewReplayer(cpusim.NewAllocator(nil)).Replay(tr)
+			}
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			t.Log(err)
+		})
+	}
+}
@@ -10,10 +10,13 @@ import (
 )
 
 const (
-	ptrSize = 8
+	ptrSize = 4 << (^uintptr(0) >> 63)
 	ptrBits = 8 * ptrSize
 )
 
+// PtrSize is the size of a pointer word in bytes.
+const PtrSize = ptrSize
+
 // typePointers is an iterator over the pointers in a heap object.
 //
 // Iteration through this type implements the tiling algorithm described at the
@@ -39,13 +42,6 @@ type typePointers struct {
 	typ *FakeType
 }
 
-// Read the bytes starting at the aligned pointer p into a uintptr.
-// Read is little-endian.
-func readUintptr(p *byte) uintptr {
-	// Little endian only.
-	return *(*uintptr)(unsafe.Pointer(p))
-}
-
 // nextFast is the fast path of next. nextFast is written to be inlineable and,
 // as the name implies, fast.
 //
@@ -0,0 +1,52 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/mknyszek/region-eval/cpusim"
+)
+
+func FuzzTypePointers(f *testing.F) {
+	f.Add([]byte{0x01}, uint8(0), uint8(0), uint8(0), uint8(0))
+	f.Add([]byte{0x05}, uint8(2), uint8(0), uint8(3), uint8(1))
+	f.Add([]byte{0xff, 0x00, 0xaa, 0x55, 0x01, 0x80, 0x00, 0x00, 0x81}, uint8(70), uint8(2), uint8(5), uint8(100))
+	f.Add([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, uint8(99), uint8(1), uint8(7), uint8(63))
+	f.Fuzz(func(t *testing.T, bitmap []byte, elemWords, arrLen, nelems, trailing uint8) {
+		// Build an element type from the bitmap, one word at a time.
+		nw := 1 + int(elemWords)%100
+		elemMask := make([]bool, nw)
+		fields := make([]*cpusim.FakeType, nw)
+		for i := range nw {
+			elemMask[i] = i/8 < len(bitmap) && bitmap[i/8]&(1<<(i%8)) != 0
+			if elemMask[i] {
+				fields[i] = cpusim.FakePointer()
+			} else {
+				fields[i] = cpusim.FakeScalar(cpusim.PtrSize)
+			}
+		}
+		typ := cpusim.FakeStruct(fields...)
+		if n := 1 + uintptr(arrLen)%4; n > 1 {
+			typ = cpusim.FakeArray(typ, n)
+		}
+
+		// The object is made of whole elements of typ plus, possibly,
+		// part of one more.
+		typWords := typ.Size_ / cpusim.PtrSize
+		size := (1+uintptr(nelems)%8)*typ.Size_ + uintptr(trailing)%typWords*cpusim.PtrSize
+
+		var want []uintptr
+		for w := range size / cpusim.PtrSize {
+			if elemMask[w%typWords%uintptr(nw)] {
+				want = append(want, w*cpusim.PtrSize)
+			}
+		}
+		if got := cpusim.TypePointerOffsets(typ, size); !slices.Equal(got, want) {
+			t.Errorf("type of %d words with %d pointer bytes, object of %d bytes: got pointers at %v, want %v", typWords, typ.PtrBytes, size, got, want)
+		}
+	})
+}
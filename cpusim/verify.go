@@ -0,0 +1,173 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpusim
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// debugVerify makes Allocator.Reset verify the allocator's memory before
+// and after resetting, and panic if anything is inconsistent.
+const debugVerify = false
+
+// Verify checks the consistency of the allocator's memory. See
+// Block.Verify for the details. Unlike Block.Verify, pointers between
+// blocks are also checked, and escaped objects must not point into region
+// memory the allocator doesn't own, which may have been reused since.
+func (a *Allocator) Verify() error {
+	blockOf := func(p unsafe.Pointer) *Block {
+		if b := a.BlockOf(Pointer(p)); b != nil {
+			return b
+		}
+		for _, b := range a.existing {
+			if b.Contains(Pointer(p)) {
+				return b
+			}
+		}
+		return nil
+	}
+	for b := range a.blocks() {
+		if err := b.verify(blockOf, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks the consistency of the block's memory. It walks every
+// object via ObjBits and checks that:
+//
+//   - each object's header has a sane type and size, and the object fits
+//     in allocated lines without overlapping its neighbors,
+//   - EscBits only cover whole objects,
+//   - LineEscape has exactly the lines that contain escaped objects, and
+//   - all pointers in escaped objects that point into this block point to
+//     escaped objects.
+//
+// It returns an error describing the first inconsistency found.
+func (b *Block) Verify() error {
+	return b.verify(func(p unsafe.Pointer) *Block {
+		if b.Contains(Pointer(p)) {
+			return b
+		}
+		return nil
+	}, false)
+}
+
+// verify checks b like Verify. blockOf returns the block containing a
+// pointer, if it's known. If owned is set, pointers to region memory
+// outside of any known block are an error.
+func (b *Block) verify(blockOf func(unsafe.Pointer) *Block, owned bool) error {
+	d := b.Meta()
+	base := b.Base()
+	metaEnd := base + metaSize
+	blockEnd := base + BlockSize
+	if b.large {
+		blockEnd = base + b.nblocks*BlockSize
+	}
+
+	var (
+		lineEscape LineMask
+		escBits    [BitmapSize / 8]uint64
+		prevEnd    = metaEnd
+	)
+	for obj := range b.Objects() {
+		start := obj.start
+		end := uintptr(obj.Addr) + obj.Size
+		startIdx := (start - base) / minAlign
+		if start < prevEnd {
+			return fmt.Errorf("block %#x: object %#x overlaps previous object or block metadata ending at %#x", base, start, prevEnd)
+		}
+		prevEnd = end
+		if end > blockEnd {
+			return fmt.Errorf("block %#x: object %#x of size %d extends past the end of the block", base, start, obj.Size)
+		}
+		if obj.Type == nil {
+			return fmt.Errorf("block %#x: object %#x has nil type", base, start)
+		}
+		if obj.Type.PtrBytes > obj.Type.Size_ || obj.Type.PtrBytes > obj.Size {
+			return fmt.Errorf("block %#x: object %#x of size %d has bad type size %d with %d pointer bytes", base, start, obj.Size, obj.Type.Size_, obj.Type.PtrBytes)
+		}
+		if obj.Type.PtrBytes != 0 && obj.Type.GCData == nil {
+			return fmt.Errorf("block %#x: object %#x has pointers but no GC data", base, start)
+		}
+		startLine := (start - base) / lineSize
+		endLine := (min(end, base+BlockSize) - 1 - base) / lineSize
+		var lines LineMask
+		lines.setRange(startLine, endLine-startLine+1)
+		if !lines.andNot(b.lineAlloc).IsZero() {
+			return fmt.Errorf("block %#x: object %#x is in unallocated lines", base, start)
+		}
+
+		// Escape bits must cover either the whole object or none of it.
+		// Large objects only have escape bits for the first chunk.
+		endIdx := (min(end, base+BlockSize) - base) / minAlign
+		for i := startIdx; i < endIdx; i++ {
+			if isBitSet(&d.EscBits, i) != obj.Escaped {
+				return fmt.Errorf("block %#x: object %#x escape bits only partially set (bit %d is %t)", base, start, i, !obj.Escaped)
+			}
+			if obj.Escaped {
+				escBits[i/64] |= uint64(1) << (i % 64)
+			}
+		}
+		if obj.Escaped {
+			lineEscape = lineEscape.or(lines)
+		}
+
+		// Pointers in escaped objects must point to escaped objects.
+		if !obj.Escaped || obj.Type.PtrBytes == 0 {
+			continue
+		}
+		addr := uintptr(obj.Addr)
+		tp := typePointers{elem: addr, addr: addr, mask: readUintptr(obj.Type.GCData), typ: obj.Type}
+		for {
+			var slot uintptr
+			if tp, slot = tp.nextFast(); slot == 0 {
+				if tp, slot = tp.next(end); slot == 0 {
+					break
+				}
+			}
+			ptr := *(*unsafe.Pointer)(b.at(slot))
+			if ptr == nil {
+				continue
+			}
+			if blockOf(ptr) == nil {
+				if owned && isRegionMemory(uintptr(ptr)) {
+					return fmt.Errorf("block %#x: escaped object %#x has pointer at %#x to region memory %#x outside of the allocator", base, start, slot, uintptr(ptr))
+				}
+				// Not region memory, or not known.
+				continue
+			}
+			if !isEscaped(ptr) {
+				return fmt.Errorf("block %#x: escaped object %#x has pointer at %#x to non-escaped object %#x", base, start, slot, uintptr(ptr))
+			}
+		}
+	}
+	if b.large {
+		// Every line of an escaped large object's block is pinned.
+		if !lineEscape.IsZero() {
+			lineEscape.setAll()
+		}
+	}
+	if escBits != d.EscBits {
+		for i := uintptr(0); i < uintptr(len(escBits))*64; i++ {
+			if isBitSet(&escBits, i) != isBitSet(&d.EscBits, i) {
+				return fmt.Errorf("block %#x: escape bit %d set outside of any escaped object", base, i)
+			}
+		}
+	}
+	if lineEscape != d.LineEscape {
+		return fmt.Errorf("block %#x: LineEscape is %064b, but escaped objects are in lines %064b", base, d.LineEscape, lineEscape)
+	}
+	if stray := d.LineEscape.andNot(b.lineAlloc).Count(); stray != 0 {
+		return fmt.Errorf("block %#x: %d escaped lines are free for allocation", base, stray)
+	}
+	return nil
+}
+
+func isBitSet(b *[BitmapSize / 8]uint64, i uintptr) bool {
+	return b[i/64]&(uint64(1)<<(i%64)) != 0
+}
@@ -0,0 +1,367 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package workload generates synthetic object graphs in a cpusim.Allocator.
+//
+// The graphs are meant to resemble what real services allocate: linked
+// lists, trees, maps of slices, and request/response structs, with object
+// sizes drawn from a configurable distribution. Pointer writes go through
+// the region write barrier, which sees the allocator's blocks as region
+// arenas like it would in a real implementation, and some fraction of
+// each graph escapes, so the cost of bump allocation and escapes can be
+// measured on realistic mixes rather than homogeneous objects.
+package workload
+
+import (
+	"math/rand/v2"
+	"unsafe"
+
+	"github.com/mknyszek/region-eval/cpusim"
+	"github.com/mknyszek/region-eval/cpusim/bitmath"
+)
+
+// Shape is a kind of object graph.
+type Shape int
+
+const (
+	LinkedList Shape = iota
+	Tree
+	MapOfSlices
+	Request
+	numShapes
+)
+
+func (s Shape) String() string {
+	switch s {
+	case LinkedList:
+		return "LinkedList"
+	case Tree:
+		return "Tree"
+	case MapOfSlices:
+		return "MapOfSlices"
+	case Request:
+		return "Request"
+	}
+	return "unknown"
+}
+
+// SizeWeight is one entry of an object size distribution.
+type SizeWeight struct {
+	Size   uintptr
+	Weight float64
+}
+
+// DefaultSizes is a size distribution dominated by small objects, roughly
+// in line with what shows up in allocation profiles of Go services.
+var DefaultSizes = []SizeWeight{
+	{8, 15},
+	{16, 25},
+	{24, 10},
+	{32, 15},
+	{48, 10},
+	{64, 10},
+	{128, 7},
+	{256, 4},
+	{1024, 3},
+	{4096, 1},
+}
+
+// Config describes a workload.
+type Config struct {
+	Seed uint64
+
+	// Sizes is the distribution of object sizes. Objects that need more
+	// room for structural pointers than their drawn size are grown.
+	Sizes []SizeWeight
+
+	// PointerDensity is the fraction of words in each object that are
+	// pointers. Every object has at least as many pointer words as its
+	// place in the graph requires. Pointer words beyond that point to
+	// random objects allocated earlier in the same graph.
+	PointerDensity float64
+
+	// Mix is the relative weight of each Shape, indexed by Shape.
+	Mix [numShapes]float64
+
+	// GraphObjects is the approximate number of objects in each graph.
+	GraphObjects int
+
+	// EscapeFrac is the probability that a graph escapes once built.
+	EscapeFrac float64
+
+	// WritesPerObject is the number of extra random pointer writes to
+	// perform within each graph, per object, after building it.
+	WritesPerObject float64
+
+	// HeapFrac is the fraction of graphs allocated in the regular heap
+	// rather than in a region. It requires a generator created with
+	// NewWithHeap. Graphs in the heap never escape.
+	HeapFrac float64
+}
+
+// DefaultConfig is a middle-of-the-road workload.
+var DefaultConfig = Config{
+	Sizes:           DefaultSizes,
+	PointerDensity:  0.25,
+	Mix:             [numShapes]float64{LinkedList: 1, Tree: 1, MapOfSlices: 1, Request: 2},
+	GraphObjects:    64,
+	EscapeFrac:      0.05,
+	WritesPerObject: 0.5,
+}
+
+// Stats counts what a Generator did.
+type Stats struct {
+	Graphs         uint64
+	Allocs         uint64
+	AllocBytes     uint64 // Excluding headers.
+	HeapAllocs     uint64 // Allocations in the regular heap, included in Allocs.
+	HeapAllocBytes uint64
+	PointerWrites  uint64
+	Writes         [cpusim.NumWriteKinds]uint64 // PointerWrites by kind.
+	Escapes        uint64                       // Graphs that escaped.
+}
+
+// Generator builds object graphs in an allocator.
+type Generator struct {
+	Stats
+
+	a     *cpusim.Allocator
+	heap  *cpusim.BaselineAllocator
+	r     *rand.Rand
+	cfg   Config
+	types map[typeKey]*cpusim.FakeType
+
+	// objs holds every object allocated for the graph currently being
+	// built, and nptrs the number of leading pointer words in each.
+	// inHeap is whether the graph is being built in the heap.
+	objs   []cpusim.Pointer
+	nptrs  []uintptr
+	inHeap bool
+}
+
+type typeKey struct {
+	size  uintptr
+	nptrs uintptr
+}
+
+// New creates a new Generator that allocates from a.
+func New(a *cpusim.Allocator, cfg Config) *Generator {
+	return NewWithHeap(a, nil, cfg)
+}
+
+// NewWithHeap creates a new Generator that allocates from a, and from
+// heap for the graphs that cfg.HeapFrac puts in the regular heap.
+func NewWithHeap(a *cpusim.Allocator, heap *cpusim.BaselineAllocator, cfg Config) *Generator {
+	if cfg.HeapFrac != 0 && heap == nil {
+		panic("HeapFrac requires a heap")
+	}
+	if len(cfg.Sizes) == 0 {
+		cfg.Sizes = DefaultSizes
+	}
+	if cfg.GraphObjects == 0 {
+		cfg.GraphObjects = DefaultConfig.GraphObjects
+	}
+	return &Generator{
+		a:     a,
+		heap:  heap,
+		r:     rand.New(rand.NewPCG(cfg.Seed, cfg.Seed)),
+		cfg:   cfg,
+		types: make(map[typeKey]*cpusim.FakeType),
+	}
+}
+
+// Next builds one graph with a shape drawn from the configured mix,
+// performs random writes within it, and escapes it with probability
+// EscapeFrac. It returns the root of the graph.
+func (g *Generator) Next() cpusim.Pointer {
+	var total float64
+	for _, w := range g.cfg.Mix {
+		total += w
+	}
+	shape := Request
+	x := g.r.Float64() * total
+	for s, w := range g.cfg.Mix {
+		if x < w {
+			shape = Shape(s)
+			break
+		}
+		x -= w
+	}
+	return g.Build(shape)
+}
+
+// Build builds one graph of the given shape, performs random writes
+// within it, and escapes it with probability EscapeFrac. It returns the
+// root of the graph.
+//
+// With probability HeapFrac, the graph is built in the heap instead, and
+// doesn't escape.
+func (g *Generator) Build(shape Shape) cpusim.Pointer {
+	g.objs = g.objs[:0]
+	g.nptrs = g.nptrs[:0]
+	// Don't draw a random number unless there's a heap, so that
+	// workloads without one stay the same.
+	g.inHeap = g.heap != nil && g.r.Float64() < g.cfg.HeapFrac
+	n := g.cfg.GraphObjects
+	var root cpusim.Pointer
+	switch shape {
+	case LinkedList:
+		root = g.linkedList(n)
+	case Tree:
+		// A binary tree of depth d has 2^(d+1)-1 nodes.
+		depth := 0
+		for 1<<(depth+2)-1 <= n {
+			depth++
+		}
+		root = g.tree(depth, 2)
+	case MapOfSlices:
+		buckets := max(1, n/8)
+		root = g.mapOfSlices(buckets, max(1, n/buckets-2))
+	case Request:
+		root = g.request(n)
+	default:
+		panic("unknown shape")
+	}
+	for range int(g.cfg.WritesPerObject * float64(len(g.objs))) {
+		g.randomWrite()
+	}
+	if g.r.Float64() < g.cfg.EscapeFrac && !g.inHeap {
+		cpusim.MarkEscaped(root)
+		g.Escapes++
+	}
+	g.Graphs++
+	return root
+}
+
+// linkedList builds a singly-linked list of n nodes.
+func (g *Generator) linkedList(n int) cpusim.Pointer {
+	head := g.alloc(1)
+	prev := head
+	for range n - 1 {
+		x := g.alloc(1)
+		g.write(prev, 0, x)
+		prev = x
+	}
+	return head
+}
+
+// tree builds a complete tree of the given depth and fanout.
+func (g *Generator) tree(depth, fanout int) cpusim.Pointer {
+	x := g.alloc(uintptr(fanout))
+	if depth > 0 {
+		for i := range fanout {
+			g.write(x, i, g.tree(depth-1, fanout))
+		}
+	}
+	return x
+}
+
+// mapOfSlices builds something like a map[K][]*V: an array of bucket
+// pointers, each pointing to a slice backing array of element pointers.
+func (g *Generator) mapOfSlices(buckets, elems int) cpusim.Pointer {
+	m := g.allocExact(uintptr(buckets)*cpusim.PtrSize, uintptr(buckets))
+	for i := range buckets {
+		s := g.allocExact(uintptr(elems)*cpusim.PtrSize, uintptr(elems))
+		g.write(m, i, s)
+		for j := range elems {
+			g.write(s, j, g.alloc(0))
+		}
+	}
+	return m
+}
+
+// request builds a request/response pair, like what an RPC handler
+// allocates: a request struct pointing to a header map, a body buffer and
+// a context, plus a response struct pointing back at the request along
+// with its own body and a list of records of n objects in total.
+func (g *Generator) request(n int) cpusim.Pointer {
+	req := g.alloc(3)
+	g.write(req, 0, g.mapOfSlices(4, 1))
+	g.write(req, 1, g.allocExact(g.size(), 0))
+	g.write(req, 2, g.alloc(2))
+
+	resp := g.alloc(3)
+	g.write(resp, 0, req)
+	g.write(resp, 1, g.allocExact(g.size(), 0))
+	if remaining := n - len(g.objs); remaining > 0 {
+		g.write(resp, 2, g.linkedList(remaining))
+	}
+	return resp
+}
+
+// alloc allocates an object of a random size with at least nptrs pointer
+// words at the start, and enough pointer words overall to hit the target
+// pointer density.
+func (g *Generator) alloc(nptrs uintptr) cpusim.Pointer {
+	size := max(g.size(), nptrs*cpusim.PtrSize)
+	ptrs := max(nptrs, uintptr(g.cfg.PointerDensity*float64(size/cpusim.PtrSize)))
+	x := g.allocExact(size, ptrs)
+
+	// Point extra pointer words at random earlier objects in the graph.
+	for i := nptrs; i < ptrs && len(g.objs) > 1; i++ {
+		g.write(x, int(i), g.objs[g.r.IntN(len(g.objs)-1)])
+	}
+	return x
+}
+
+// allocExact allocates an object of exactly the given size whose first
+// nptrs words are pointers.
+func (g *Generator) allocExact(size, nptrs uintptr) cpusim.Pointer {
+	k := typeKey{size, nptrs}
+	typ, ok := g.types[k]
+	if !ok {
+		gcdata := make([]byte, bitmath.AlignUp((nptrs+7)/8, cpusim.PtrSize))
+		for i := range nptrs {
+			gcdata[i/8] |= 1 << (i % 8)
+		}
+		typ = cpusim.NewFakeType(size, nptrs*cpusim.PtrSize, gcdata)
+		g.types[k] = typ
+	}
+	var x cpusim.Pointer
+	if g.inHeap {
+		x = g.heap.Make(size, typ)
+		g.HeapAllocs++
+		g.HeapAllocBytes += uint64(size)
+	} else {
+		x = g.a.Make(size, typ)
+	}
+	g.objs = append(g.objs, x)
+	g.nptrs = append(g.nptrs, nptrs)
+	g.Allocs++
+	g.AllocBytes += uint64(size)
+	return x
+}
+
+// size draws an object size from the distribution.
+func (g *Generator) size() uintptr {
+	var total float64
+	for _, s := range g.cfg.Sizes {
+		total += s.Weight
+	}
+	x := g.r.Float64() * total
+	for _, s := range g.cfg.Sizes {
+		if x < s.Weight {
+			return s.Size
+		}
+		x -= s.Weight
+	}
+	return g.cfg.Sizes[len(g.cfg.Sizes)-1].Size
+}
+
+// randomWrite overwrites a random pointer slot in a random object of the
+// current graph with a pointer to another random object in the graph.
+func (g *Generator) randomWrite() {
+	i := g.r.IntN(len(g.objs))
+	if g.nptrs[i] == 0 {
+		return
+	}
+	g.write(g.objs[i], g.r.IntN(int(g.nptrs[i])), g.objs[g.r.IntN(len(g.objs))])
+}
+
+// write stores ptr into the i'th word of obj, with a write barrier.
+func (g *Generator) write(obj cpusim.Pointer, i int, ptr cpusim.Pointer) {
+	k := cpusim.WritePointer(unsafe.Add(unsafe.Pointer(obj), i*cpusim.PtrSize), unsafe.Pointer(ptr))
+	g.PointerWrites++
+	g.Writes[k]++
+}
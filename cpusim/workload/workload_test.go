@@ -0,0 +1,301 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package workload_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/aclements/go-perfevent/perfbench"
+	"github.com/mknyszek/region-eval/cpusim"
+	"github.com/mknyszek/region-eval/cpusim/workload"
+)
+
+func TestGenerator(t *testing.T) {
+	for shape := workload.LinkedList; shape <= workload.Request; shape++ {
+		for _, density := range []float64{0, 0.25, 1} {
+			t.Run(fmt.Sprintf("shape=%s/density=%v", shape, density), func(t *testing.T) {
+				a := cpusim.NewAllocator(nil)
+				cfg := workload.DefaultConfig
+				cfg.PointerDensity = density
+				cfg.EscapeFrac = 0.5
+				g := workload.New(a, cfg)
+
+				var escaped int
+				for range 50 {
+					root := g.Build(shape)
+					// The write barrier only takes its region path
+					// for memory in region arenas.
+					if arena := uintptr(unsafe.Pointer(root)) / cpusim.HeapArenaBytes; cpusim.IsRegionArena[arena/64]&(uint64(1)<<(arena%64)) == 0 {
+						t.Fatalf("root %p not in a region arena", root)
+					}
+					if cpusim.IsEscaped(root) {
+						escaped++
+					}
+				}
+				if uint64(escaped) != g.Escapes {
+					t.Errorf("found %d escaped roots, generator reported %d", escaped, g.Escapes)
+				}
+				if g.Escapes == 0 || g.Escapes == g.Graphs {
+					t.Errorf("%d of %d graphs escaped, expected about half", g.Escapes, g.Graphs)
+				}
+				if g.Allocs < 50*uint64(cfg.GraphObjects)/2 {
+					t.Errorf("only %d allocations for 50 graphs", g.Allocs)
+				}
+				if err := a.Verify(); err != nil {
+					t.Fatal(err)
+				}
+				s := a.Stats()
+				if uint64(s.Objects) != g.Allocs {
+					t.Errorf("allocator has %d objects, generator allocated %d", s.Objects, g.Allocs)
+				}
+				if s.EscapedObjects < int(g.Escapes) {
+					t.Errorf("only %d escaped objects for %d escaped graphs", s.EscapedObjects, g.Escapes)
+				}
+				a.Reset()
+				if err := a.Verify(); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+// TestGeneratorEscapeTransitive checks that escaping a graph's root
+// escapes every object in the graph. Without extra pointers or random
+// writes, everything is reachable from the root, so this catches
+// structural pointers that were written outside the pointer words of
+// their object's type, which the write barrier won't follow.
+func TestGeneratorEscapeTransitive(t *testing.T) {
+	for shape := workload.LinkedList; shape <= workload.Request; shape++ {
+		t.Run(shape.String(), func(t *testing.T) {
+			a := cpusim.NewAllocator(nil)
+			cfg := workload.DefaultConfig
+			cfg.PointerDensity = 0
+			cfg.WritesPerObject = 0
+			cfg.EscapeFrac = 1
+			g := workload.New(a, cfg)
+			for range 10 {
+				g.Build(shape)
+				s := a.Stats()
+				if s.EscapedObjects != s.Objects {
+					t.Fatalf("%d of %d objects escaped, want all of them", s.EscapedObjects, s.Objects)
+				}
+				if err := a.Verify(); err != nil {
+					t.Fatal(err)
+				}
+				a.Reset()
+			}
+		})
+	}
+}
+
+func TestGeneratorDeterministic(t *testing.T) {
+	run := func() workload.Stats {
+		cfg := workload.DefaultConfig
+		cfg.Seed = 42
+		g := workload.New(cpusim.NewAllocator(nil), cfg)
+		for range 100 {
+			g.Next()
+		}
+		return g.Stats
+	}
+	if s1, s2 := run(), run(); s1 != s2 {
+		t.Errorf("same seed produced different workloads: %+v vs. %+v", s1, s2)
+	}
+}
+
+func TestGCWorkWithRegions(t *testing.T) {
+	// Run the same workload with more and more of it in regions, and see
+	// how the toy collector's work changes.
+	var base gcWork
+	prev := uint64(0)
+	for i, regionFrac := range []float64{0, 0.25, 0.5, 0.75, 0.9, 1} {
+		w := simulateGC(t, regionFrac)
+		if i == 0 {
+			base = w
+			if w.RegionBytesScanned != 0 || w.EscapedBytesScanned != 0 {
+				t.Errorf("scanned region memory without any regions: %+v", w.GCStats)
+			}
+		} else if w.BytesScanned() > prev {
+			t.Errorf("regionFrac=%v: GC work went up to %d bytes from %d", regionFrac, w.BytesScanned(), prev)
+		}
+		prev = w.BytesScanned()
+		t.Logf("regionFrac=%.2f measured=%.2f: %d cycles, GC work %.3f of baseline (%.3f escaped, %.3f live region)",
+			regionFrac, w.regionAllocBytesFrac, w.cycles,
+			float64(w.BytesScanned())/float64(base.BytesScanned()),
+			float64(w.EscapedBytesScanned)/float64(base.BytesScanned()),
+			float64(w.RegionBytesScanned)/float64(base.BytesScanned()))
+	}
+}
+
+// gcWork is the total work done by the collector over a simulation.
+type gcWork struct {
+	cpusim.GCStats
+	cycles               int
+	regionAllocBytesFrac float64
+}
+
+func (w *gcWork) add(s cpusim.GCStats) {
+	w.cycles++
+	w.HeapObjectsScanned += s.HeapObjectsScanned
+	w.HeapBytesScanned += s.HeapBytesScanned
+	w.RegionObjectsScanned += s.RegionObjectsScanned
+	w.RegionBytesScanned += s.RegionBytesScanned
+	w.EscapedObjectsScanned += s.EscapedObjectsScanned
+	w.EscapedBytesScanned += s.EscapedBytesScanned
+	w.PointersScanned += s.PointersScanned
+	w.HeapObjectsFreed += s.HeapObjectsFreed
+	w.HeapBytesFreed += s.HeapBytesFreed
+}
+
+// simulateGC runs a server-like workload where regionFrac of the graphs
+// are built in regions, one region per request, and the rest in the
+// heap, collecting the heap as it grows.
+//
+// Each request builds a few graphs and keeps some of them around after
+// it's done, in a fixed-size set of retained graphs that stands in for
+// long-lived state. Region graphs are retained if they escape. Heap
+// graphs are retained with the same probability. The heap is collected
+// every time it grows by a fixed number of bytes, counting escaped
+// region memory as growth, since that's memory the GC has to manage.
+func simulateGC(t *testing.T, regionFrac float64) gcWork {
+	const (
+		requests         = 2000
+		graphsPerRequest = 4
+		retainedGraphs   = 64
+		gcTrigger        = 1 << 20
+	)
+	heap := cpusim.NewBaselineAllocator()
+	a := cpusim.NewAllocator(nil)
+	c := cpusim.NewCollector(heap)
+	cfg := workload.DefaultConfig
+	cfg.Seed = 1
+	cfg.HeapFrac = 1 - regionFrac
+	g := workload.NewWithHeap(a, heap, cfg)
+	r := rand.New(rand.NewPCG(2, 2))
+
+	var (
+		w        gcWork
+		retained []cpusim.Pointer
+		current  []cpusim.Pointer
+		growth   uint64
+	)
+	retain := func(p cpusim.Pointer) {
+		if len(retained) < retainedGraphs {
+			retained = append(retained, p)
+		} else {
+			retained[r.IntN(len(retained))] = p
+		}
+	}
+	for range requests {
+		for range graphsPerRequest {
+			allocBytes, heapBytes := g.AllocBytes, g.HeapAllocBytes
+			root := g.Next()
+			current = append(current, root)
+			growth += g.HeapAllocBytes - heapBytes
+			if cpusim.IsEscaped(root) {
+				growth += g.AllocBytes - allocBytes
+				retain(root)
+			} else if g.HeapAllocBytes != heapBytes && r.Float64() < cfg.EscapeFrac {
+				retain(root)
+			}
+			if growth >= gcTrigger {
+				w.add(c.Collect(slices.Concat(retained, current)))
+				growth = 0
+			}
+		}
+		// The request is done.
+		a.Reset()
+		current = current[:0]
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	w.regionAllocBytesFrac = 1 - float64(g.HeapAllocBytes)/float64(g.AllocBytes)
+	return w
+}
+
+const llcBytes = 16 << 20 // LLC size or larger
+
+var ballast []byte
+
+func BenchmarkWorkload(b *testing.B) {
+	for _, density := range []float64{0, 0.25, 0.5} {
+		for _, escape := range []float64{0, 0.05, 0.25} {
+			b.Run(fmt.Sprintf("density=%v/escape=%v", density, escape), func(b *testing.B) {
+				cfg := workload.DefaultConfig
+				cfg.PointerDensity = density
+				cfg.EscapeFrac = escape
+				benchWorkload(b, cfg)
+			})
+		}
+	}
+}
+
+func benchWorkload(b *testing.B, cfg workload.Config) {
+	cs := perfbench.Open(b)
+
+	// Block memory lives in region arenas outside the Go heap, but each
+	// new Block still allocates a little from it. Use a ballast so that
+	// doesn't trigger a GC. Its size also sets how much to allocate
+	// between resets.
+	ballast = make([]byte, llcBytes)
+	defer func() { ballast = nil }()
+
+	a := cpusim.NewAllocator(nil)
+	g := workload.New(a, cfg)
+
+	runtime.GC()
+	var mstats runtime.MemStats
+	runtime.ReadMemStats(&mstats)
+	startGCs := mstats.NumGC
+
+	b.ResetTimer()
+	cs.Reset()
+
+	var last uint64
+	for range b.N {
+		g.Next()
+		if g.AllocBytes-last > uint64(len(ballast)/4) {
+			// End the region, and run GC manually so we can exclude GC
+			// time from the benchmark results.
+			a.Reset()
+			cs.Stop()
+			b.StopTimer()
+			last = g.AllocBytes
+			runtime.GC()
+			startGCs++
+			b.StartTimer()
+			cs.Start()
+		}
+	}
+
+	cs.Stop()
+	b.StopTimer()
+
+	bytes := float64(g.AllocBytes)
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/bytes, "ns/byte")
+	if cycles, ok := cs.Total("cpu-cycles"); ok {
+		b.ReportMetric(cycles/bytes, "cpu-cycles/byte")
+	}
+	b.ReportMetric(float64(g.Allocs)/float64(b.N), "objects/op")
+	b.ReportMetric(float64(g.PointerWrites)/float64(b.N), "ptr-writes/op")
+	for k, n := range g.Writes {
+		b.ReportMetric(float64(n)/float64(b.N), fmt.Sprintf("%s-writes/op", cpusim.WriteKind(k)))
+	}
+	b.ReportMetric(float64(g.Escapes)/float64(b.N), "escapes/op")
+
+	// Confirm that no automatic GCs happened during the benchmark.
+	runtime.ReadMemStats(&mstats)
+	endGCs := mstats.NumGC
+	if endGCs != startGCs {
+		b.Fatalf("%d unaccounted GCs", endGCs-startGCs)
+	}
+}
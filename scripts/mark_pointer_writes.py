@@ -0,0 +1,52 @@
+# Copyright 2024 The Go Authors. All rights reserved.
+# Use of this source code is governed by a BSD-style
+# license that can be found in the LICENSE file.
+
+# Estimates how many pointer writes happen while the GC is marking, from
+# a GODEBUG=gctrace=1 trace of a ptrcount build, whose gc lines end with
+# cumulative pointer write, object and byte counters ("123w 45o 6789b").
+#
+# The trace only has counters at the end of each cycle, so writes are
+# assumed to be spread evenly over time between them. Each cycle's writes
+# are charged to marking in proportion to how much of the time since the
+# previous cycle ended was spent in concurrent mark. That's only an
+# approximation: allocation-heavy phases tend to both write more pointers
+# and trigger more GCs.
+#
+# Prints the total pointer writes and the estimated writes during mark for
+# each process in the trace. Cycles up to and including the given cycle
+# number, if any, are left out, to skip a benchmark's warmup.
+
+import re
+import sys
+
+start = int(sys.argv[1]) if len(sys.argv) > 1 else 0
+
+gc_line = re.compile(r"gc (\d+) @([\d.]+)s \d+%: [\d.]+\+([\d.]+)\+[\d.]+ ms clock, .* (\d+)w \d+o \d+b$")
+
+def report():
+    if last_n is not None:
+        print(total_writes, int(mark_writes))
+
+last_n = None
+for line in sys.stdin:
+    m = gc_line.search(line.rstrip())
+    if not m:
+        continue
+    n = int(m.group(1))
+    mark = float(m.group(3)) / 1000
+    end = float(m.group(2)) + mark
+    writes = int(m.group(4))
+    if last_n is None or n <= last_n:
+        # A new process.
+        report()
+        prev_end, prev_writes = 0, 0
+        total_writes, mark_writes = 0, float(0)
+    last_n = n
+    if n > start:
+        w = writes - prev_writes
+        total_writes += w
+        if end > prev_end:
+            mark_writes += w * min(1, mark / (end - prev_end))
+    prev_end, prev_writes = end, writes
+report()